@@ -3,14 +3,19 @@ package config
 import (
 	"encoding/json"
 	"log"
+	"net"
 	"os"
+	"time"
 )
 
 const configLocation = "./config/config.json"
 
 type Redis struct {
-	Port     int `json:"port"`
-	Database int `json:"db"`
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Database  int    `json:"db"`
+	MaxIdle   int    `json:"maxIdle"`
+	MaxActive int    `json:"maxActive"`
 }
 
 type WSUsers struct {
@@ -19,13 +24,61 @@ type WSUsers struct {
 }
 
 type Network struct {
-	IP   string  `json:"ip"`
-	Mask [4]byte `json:"mask"`
+	IP     string  `json:"ip"`
+	Mask   [4]byte `json:"mask"`
+	Server string  `json:"server"`
+}
+
+func (network Network) IPNet() net.IPNet {
+	return net.IPNet{
+		IP:   net.ParseIP(network.IP).To4(),
+		Mask: net.IPv4Mask(network.Mask[0], network.Mask[1], network.Mask[2], network.Mask[3]),
+	}
+}
+
+// ServerIP is the address the server holds inside the network, the first host address unless configured
+func (network Network) ServerIP() net.IP {
+	if network.Server != "" {
+		return net.ParseIP(network.Server).To4()
+	}
+
+	ipNet := network.IPNet()
+	if ipNet.IP == nil {
+		return nil
+	}
+
+	server := make(net.IP, len(ipNet.IP))
+	copy(server, ipNet.IP.Mask(ipNet.Mask))
+	server[len(server)-1]++
+	return server
 }
 
 type WSGroup struct {
-	Description string  `json:"description"`
-	Network     Network `json:"network"`
+	Description      string   `json:"description"`
+	Interface        string   `json:"interface"`
+	Network          Network  `json:"network"`
+	ClientAllowedIPs []string `json:"clientAllowedIPs"`
+	DNS              []string `json:"dns"`
+	PresharedKey     bool     `json:"presharedKey"`
+	StaleAfter       string   `json:"staleAfter"`  // duration without a handshake before a peer is stale, empty never
+	StalePolicy      string   `json:"stalePolicy"` // "disable" or "delete" stale peers automatically, empty only lists them
+}
+
+// StaleThreshold is how long a peer in the group can go without a handshake, 0 if staleness isn't tracked
+func (group WSGroup) StaleThreshold() time.Duration {
+	threshold, err := time.ParseDuration(group.StaleAfter)
+	if err != nil || threshold < 0 {
+		return 0
+	}
+	return threshold
+}
+
+// AuthLimits slows down and locks out repeated failed logins, zero values use the defaults
+type AuthLimits struct {
+	MaxFailures int    `json:"maxFailures"` // failures in a row before a lockout
+	BaseBackoff string `json:"baseBackoff"` // wait after the first failure, doubled with every one after
+	MaxBackoff  string `json:"maxBackoff"`
+	Lockout     string `json:"lockout"`
 }
 
 type Websocket struct {
@@ -33,10 +86,14 @@ type Websocket struct {
 	AdminPassword string             `json:"adminPassword"`
 	Users         map[string]WSUsers `json:"users"`
 	Groups        map[string]WSGroup `json:"groups"`
+	AuthLimits    AuthLimits         `json:"authLimits"`
 }
 
 type Interface struct {
-	Name string `json:"name"`
+	Name         string `json:"name"`
+	Endpoint     string `json:"endpoint"`
+	ListenPort   int    `json:"listenPort"`
+	FirewallMark int    `json:"firewallMark"`
 }
 
 type StorageType struct {
@@ -45,10 +102,21 @@ type StorageType struct {
 }
 
 type Config struct {
-	Interface *Interface     `json:"interface"`
-	Websocket *Websocket     `json:"ws"`
-	Redis     *Redis         `json:"redis"`
-	Storage   []*StorageType `json:"storage"`
+	Interfaces        []*Interface   `json:"interfaces"`
+	Interface         *Interface     `json:"interface"` // single interface of older configs, folded into Interfaces on load
+	Websocket         *Websocket     `json:"ws"`
+	Store             string         `json:"store"`
+	ReconcileInterval string         `json:"reconcileInterval"`
+	ExpiryInterval    string         `json:"expiryInterval"`
+	ExpiredPeers      string         `json:"expiredPeers"` // "delete" or "archive"
+	StaleInterval     string         `json:"staleInterval"`
+	TrafficInterval   string         `json:"trafficInterval"`
+	WatchInterval     string         `json:"watchInterval"`
+	SessionLifetime   string         `json:"sessionLifetime"`
+	MetricsAddress    string         `json:"metricsAddress"` // host:port to serve /metrics on, kept off the websocket port, empty disables it
+	SecretKey         string         `json:"secretKey"`
+	Redis             *Redis         `json:"redis"`
+	Storage           []*StorageType `json:"storage"`
 }
 
 func LoadConfiguration() (conf Config) {
@@ -60,9 +128,36 @@ func LoadConfiguration() (conf Config) {
 
 	jsonParser := json.NewDecoder(configFile)
 	jsonParser.Decode(&conf)
+
+	if len(conf.Interfaces) == 0 && conf.Interface != nil {
+		conf.Interfaces = []*Interface{conf.Interface}
+	}
+	conf.Interface = nil
+
+	if len(conf.Interfaces) == 0 {
+		log.Fatal("no interfaces configured")
+	}
+
 	return
 }
 
+func (conf Config) GetInterface(name string) *Interface {
+	for _, iface := range conf.Interfaces {
+		if iface.Name == name {
+			return iface
+		}
+	}
+	return nil
+}
+
+// GroupInterface is the interface the group's peers live on, groups without one use the first interface
+func (conf Config) GroupInterface(group string) *Interface {
+	if name := conf.Websocket.Groups[group].Interface; name != "" {
+		return conf.GetInterface(name)
+	}
+	return conf.Interfaces[0]
+}
+
 func GetDefaultOf(storageType string) string {
 	switch storageType {
 	case "string":
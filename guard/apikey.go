@@ -0,0 +1,80 @@
+package guard
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	Uuid "github.com/nu7hatch/gouuid"
+)
+
+// CreateApiKey stores a new key with the given group scopes and returns its secret, which is never stored
+func (guard *Guard) CreateApiKey(name string, groups map[string][]string, expiresAt time.Time) (string, *ApiKey, error) {
+	for group := range groups {
+		if _, ok := guard.config.Websocket.Groups[group]; !ok {
+			return "", nil, fmt.Errorf("unknown group %s", group)
+		}
+	}
+
+	id, err := Uuid.NewV4()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to generate api key")
+	}
+
+	secretBytes := make([]byte, 32)
+	_, err = rand.Read(secretBytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to generate api key")
+	}
+	secret := "bgk_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	key := &ApiKey{
+		Id:        id.String(),
+		Name:      name,
+		Hash:      hashToken(secret),
+		Groups:    groups,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	err = guard.store.SetApiKey(key)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to store api key: %w", err)
+	}
+
+	return secret, key, nil
+}
+
+func (guard *Guard) GetApiKeys() ([]*ApiKey, error) {
+	return guard.store.GetApiKeys()
+}
+
+func (guard *Guard) GetApiKey(id string) (*ApiKey, error) {
+	return guard.store.GetApiKey(id)
+}
+
+func (guard *Guard) RevokeApiKey(id string) error {
+	return guard.store.DeleteApiKey(id)
+}
+
+// AuthenticateApiKey returns the unexpired key matching secret, marking it as used
+func (guard *Guard) AuthenticateApiKey(secret string) (*ApiKey, error) {
+	key, err := guard.store.GetApiKeyByHash(hashToken(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !key.ExpiresAt.IsZero() && now.After(key.ExpiresAt) {
+		return nil, ErrApiKeyNotFound
+	}
+
+	key.LastUsed = now
+	err = guard.store.TouchApiKey(key.Id, now)
+	if err != nil {
+		fmt.Printf("Unable to record use of api key %s: %s\n", key.Id, err)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,54 @@
+package guard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApiKeys(t *testing.T) {
+	guard, _, _ := createTestGuard(t)
+
+	if _, _, err := guard.CreateApiKey("ci", map[string][]string{"missing": {"peers.get"}}, time.Time{}); err == nil {
+		t.Errorf("created a key scoped to an unknown group")
+	}
+
+	secret, key, err := guard.CreateApiKey("ci", map[string][]string{"test": {"peers.get"}}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Hash == secret {
+		t.Errorf("secret stored as is")
+	}
+
+	authenticated, err := guard.AuthenticateApiKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authenticated.Id != key.Id || authenticated.LastUsed.IsZero() {
+		t.Errorf("authenticated %+v, want %s marked as used", authenticated, key.Id)
+	}
+
+	stored, _ := guard.GetApiKey(key.Id)
+	if stored.LastUsed.IsZero() {
+		t.Errorf("use of the key not stored")
+	}
+
+	if _, err := guard.AuthenticateApiKey(secret + "x"); err != ErrApiKeyNotFound {
+		t.Errorf("wrong secret: err = %v, want ErrApiKeyNotFound", err)
+	}
+
+	if err := guard.RevokeApiKey(key.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := guard.AuthenticateApiKey(secret); err != ErrApiKeyNotFound {
+		t.Errorf("revoked key: err = %v, want ErrApiKeyNotFound", err)
+	}
+
+	expiredSecret, _, err := guard.CreateApiKey("old", map[string][]string{"test": {"peers.get"}}, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := guard.AuthenticateApiKey(expiredSecret); err != ErrApiKeyNotFound {
+		t.Errorf("expired key: err = %v, want ErrApiKeyNotFound", err)
+	}
+}
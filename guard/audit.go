@@ -0,0 +1,17 @@
+package guard
+
+import (
+	"fmt"
+)
+
+// Audit stores an audit entry, a failure is logged rather than failing the change it records
+func (guard *Guard) Audit(entry *AuditEntry) {
+	err := guard.store.AddAudit(entry)
+	if err != nil {
+		fmt.Printf("Unable to record audit entry for %s: %s\n", entry.Method, err)
+	}
+}
+
+func (guard *Guard) QueryAudit(filter AuditFilter) ([]*AuditEntry, error) {
+	return guard.store.QueryAudit(filter)
+}
@@ -0,0 +1,83 @@
+package guard
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// RenderClientConfig builds a wg-quick config for the peer's side of the tunnel.
+// privateKey is only known right after generation, otherwise a placeholder is written in its place.
+func (guard *Guard) RenderClientConfig(peer *Peer, privateKey string) (string, error) {
+	iface := guard.config.GetInterface(peer.Interface)
+	if iface == nil {
+		return "", ErrInterfaceNotFound
+	}
+
+	device, err := guard.device(iface.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if iface.Endpoint == "" {
+		return "", fmt.Errorf("no endpoint configured for %s", iface.Name)
+	}
+
+	group := guard.config.Websocket.Groups[peer.Group]
+
+	addresses := make([]string, 0, len(peer.AllowedIPs))
+	for _, allowedIP := range peer.AllowedIPs {
+		addresses = append(addresses, allowedIP.String())
+	}
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("peer has no addresses")
+	}
+
+	clientAllowedIPs := group.ClientAllowedIPs
+	if len(clientAllowedIPs) == 0 && group.Network.IP != "" {
+		network := group.Network.IPNet()
+		clientAllowedIPs = []string{(&network).String()}
+	}
+
+	if privateKey == "" {
+		privateKey = "<private key>"
+	}
+
+	conf := strings.Builder{}
+
+	conf.WriteString("[Interface]\n")
+	fmt.Fprintf(&conf, "PrivateKey = %s\n", privateKey)
+	fmt.Fprintf(&conf, "Address = %s\n", strings.Join(addresses, ", "))
+	if len(group.DNS) > 0 {
+		fmt.Fprintf(&conf, "DNS = %s\n", strings.Join(group.DNS, ", "))
+	}
+
+	conf.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&conf, "PublicKey = %s\n", device.PublicKey.String())
+	if peer.PresharedKey != "" {
+		fmt.Fprintf(&conf, "PresharedKey = %s\n", peer.PresharedKey)
+	}
+	fmt.Fprintf(&conf, "Endpoint = %s\n", iface.Endpoint)
+	fmt.Fprintf(&conf, "AllowedIPs = %s\n", strings.Join(clientAllowedIPs, ", "))
+	if peer.KeepAlive > 0 {
+		fmt.Fprintf(&conf, "PersistentKeepalive = %d\n", int(peer.KeepAlive.Seconds()))
+	}
+
+	return conf.String(), nil
+}
+
+// RenderQRCode encodes a client config as a PNG of the given size and as half-block text for terminals
+func RenderQRCode(clientConfig string, size int) (png []byte, ascii string, err error) {
+	code, err := qrcode.New(clientConfig, qrcode.Medium)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to encode qr code")
+	}
+
+	png, err = code.PNG(size)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to encode qr code")
+	}
+
+	return png, code.ToSmallString(false), nil
+}
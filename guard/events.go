@@ -0,0 +1,63 @@
+package guard
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	EventPeerAdded     = "added"
+	EventPeerUpdated   = "updated"
+	EventPeerDeleted   = "deleted"
+	EventPeerExpired   = "expired"
+	EventPeerDisabled  = "disabled"
+	EventPeerEnabled   = "enabled"
+	EventPeerHandshake = "firstHandshake"
+	EventPeerOnline    = "online"
+	EventPeerOffline   = "offline"
+	EventPeerEndpoint  = "endpointChanged"
+)
+
+type PeerEvent struct {
+	Type  string    `json:"type"`
+	Uuid  string    `json:"uuid"`
+	Group string    `json:"group"`
+	Name  string    `json:"name"`
+	Time  time.Time `json:"time"`
+}
+
+// AddListener calls listener with every peer event until the returned func is called
+func (guard *Guard) AddListener(listener func(PeerEvent)) (remove func()) {
+	guard.listenerLock.Lock()
+	defer guard.listenerLock.Unlock()
+
+	id := guard.nextListener
+	guard.nextListener++
+	guard.listeners[id] = listener
+
+	return func() {
+		guard.listenerLock.Lock()
+		defer guard.listenerLock.Unlock()
+
+		delete(guard.listeners, id)
+	}
+}
+
+func (guard *Guard) emit(eventType string, peer *Peer) {
+	event := PeerEvent{
+		Type:  eventType,
+		Uuid:  peer.Uuid,
+		Group: peer.Group,
+		Name:  peer.Name,
+		Time:  time.Now(),
+	}
+
+	fmt.Printf("Peer %s %s\n", event.Uuid, event.Type)
+
+	guard.listenerLock.RLock()
+	defer guard.listenerLock.RUnlock()
+
+	for _, listener := range guard.listeners {
+		listener(event)
+	}
+}
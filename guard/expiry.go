@@ -0,0 +1,72 @@
+package guard
+
+import (
+	"fmt"
+	"time"
+)
+
+// StartExpirer removes expired peers every interval until the process exits
+func (guard *Guard) StartExpirer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			_, err := guard.ExpirePeers()
+			if err != nil {
+				fmt.Println("Unable to expire peers:", err)
+			}
+		}
+	}()
+}
+
+// ExpirePeers removes every peer past its expiry from its interface, returning the uuids removed
+func (guard *Guard) ExpirePeers() ([]string, error) {
+	peerMap, err := guard.store.GetPeerMap()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expired := []string{}
+
+	for _, peerUuid := range peerMap {
+		peer, err := guard.getStoredPeer(peerUuid)
+		if err != nil || peer.ExpiresAt.IsZero() || now.Before(peer.ExpiresAt) {
+			continue
+		}
+
+		err = guard.expirePeer(peer)
+		if err != nil {
+			fmt.Printf("Unable to expire peer %s: %s\n", peerUuid, err)
+			continue
+		}
+
+		expired = append(expired, peerUuid)
+	}
+
+	return expired, nil
+}
+
+// expirePeer deletes the peer, keeping its record in the archive first if configured to
+func (guard *Guard) expirePeer(peer *Peer) error {
+	if guard.config.ExpiredPeers == "archive" {
+		redisPeer, err := guard.store.GetPeer(peer.Uuid)
+		if err != nil {
+			return err
+		}
+
+		err = guard.store.ArchivePeer(redisPeer)
+		if err != nil {
+			return fmt.Errorf("unable to archive peer: %w", err)
+		}
+	}
+
+	err := guard.DeletePeer(peer.Uuid)
+	if err != nil {
+		return err
+	}
+
+	guard.emit(EventPeerExpired, peer)
+	return nil
+}
@@ -0,0 +1,84 @@
+package guard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpirePeers(t *testing.T) {
+	for _, policy := range []string{"", "archive"} {
+		guard, wg, store := createTestGuard(t)
+		guard.config.ExpiredPeers = policy
+		events := recordEvents(t, guard)
+
+		expiries := []time.Time{{}, time.Now().Add(time.Hour), time.Now().Add(-time.Minute)}
+		peers := make([]*Peer, len(expiries))
+		for i, expiresAt := range expiries {
+			peers[i] = CreatePeer(generatePublicKey(t), "test", "", "", 0, nil, map[string]string{})
+			peers[i].ExpiresAt = expiresAt
+			if err := guard.SetPeer(peers[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expired, err := guard.ExpirePeers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expired) != 1 || expired[0] != peers[2].Uuid {
+			t.Errorf("%q: expired %v, want only %s", policy, expired, peers[2].Uuid)
+		}
+
+		if _, err := guard.GetWgPeer(peers[2].Uuid); err != ErrPeerNotFound {
+			t.Errorf("%q: expired peer still stored, err = %v", policy, err)
+		}
+		for _, peer := range peers[:2] {
+			if _, err := guard.GetWgPeer(peer.Uuid); err != nil {
+				t.Errorf("%q: unexpired peer %s removed: %s", policy, peer.Uuid, err)
+			}
+		}
+
+		device, _ := wg.Device("wg0")
+		if len(device.Peers) != 2 {
+			t.Errorf("%q: %d peers on the device, want 2", policy, len(device.Peers))
+		}
+
+		_, archived := store.archive[peers[2].Uuid]
+		if archived != (policy == "archive") {
+			t.Errorf("%q: archived = %t", policy, archived)
+		}
+
+		if got := countEvents(events(), EventPeerExpired); got != 1 {
+			t.Errorf("%q: %d expired events, want 1", policy, got)
+		}
+	}
+}
+
+func TestPeerExpiresInFollowsExpiresAt(t *testing.T) {
+	guard, _, _ := createTestGuard(t)
+
+	peer := CreatePeer(generatePublicKey(t), "test", "", "", 0, nil, map[string]string{})
+	peer.ExpiresAt = time.Now().Add(time.Hour)
+	if err := guard.SetPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+	if peer.ExpiresIn != time.Hour {
+		t.Errorf("expiresIn after add = %s, want 1h", peer.ExpiresIn)
+	}
+
+	peer.ExpiresAt = time.Now().Add(2 * time.Hour)
+	if err := guard.UpdatePeer(peer); err != nil {
+		t.Fatal(err)
+	}
+	if peer.ExpiresIn != 2*time.Hour {
+		t.Errorf("expiresIn after update = %s, want 2h", peer.ExpiresIn)
+	}
+
+	peer.ExpiresAt = time.Time{}
+	if err := guard.UpdatePeer(peer); err != nil {
+		t.Fatal(err)
+	}
+	if peer.ExpiresIn != 0 {
+		t.Errorf("expiresIn after clearing the expiry = %s, want 0", peer.ExpiresIn)
+	}
+}
@@ -6,18 +6,16 @@ import (
 	"sync"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
 	Uuid "github.com/nu7hatch/gouuid"
-	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
 	"github.com/bob620/bakaguard/config"
 )
 
-const redisRoot = "bakaguard"
-const redisPeer = "peers"
-const peerSearchPublicKey = "search:publicKey"
-const redisGroups = "groups"
+var ErrPeerNotFound = fmt.Errorf("unable to find peer")
+var ErrInterfaceNotFound = fmt.Errorf("unable to find interface")
+var ErrSessionNotFound = fmt.Errorf("session expired or revoked")
+var ErrApiKeyNotFound = fmt.Errorf("api key expired or revoked")
 
 func CreateRedisPeer(publicKey, group, name, description string, storage map[string]string) *RedisPeer {
 	id, _ := Uuid.NewV4()
@@ -28,6 +26,7 @@ func CreateRedisPeer(publicKey, group, name, description string, storage map[str
 		Name:        name,
 		Description: description,
 		PublicKey:   publicKey,
+		CreatedAt:   time.Now(),
 		Storage:     storage,
 	}
 }
@@ -44,71 +43,101 @@ func CreatePeer(publicKey, group, name, description string, keepAlive time.Durat
 		Storage:       storage,
 		AllowedIPs:    allowedIPs,
 		KeepAlive:     keepAlive,
+		CreatedAt:     time.Now(),
 		LastHandshake: time.Time{},
 		LastEndpoint:  "",
 	}
 }
 
-func CreateGuard(conf config.Config, wg *wgctrl.Client, redisConn redis.Conn) *Guard {
-	return &Guard{
-		config:     conf,
-		wg:         wg,
-		redisConn:  redisConn,
-		redisRead:  sync.Mutex{},
-		redisWrite: sync.Mutex{},
+// GenerateKeyPair makes a new peer keypair, the private key is handed back to the caller and never stored
+func GenerateKeyPair() (privateKey, publicKey string, err error) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return "", "", fmt.Errorf("unable to generate private key")
 	}
+
+	return key.String(), key.PublicKey().String(), nil
 }
 
-func (guard *Guard) GetGroupPeers(group string) (peers map[string]*Peer, err error) {
-	uuids, err := guard.GetRedisPeerGroup(group)
+// GeneratePresharedKey makes a new random preshared key
+func GeneratePresharedKey() (string, error) {
+	key, err := wgtypes.GenerateKey()
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("unable to generate preshared key")
 	}
 
-	peers = make(map[string]*Peer, len(uuids))
+	return key.String(), nil
+}
 
-	for _, peerUuid := range uuids {
-		peer, err := guard.GetWgPeer(peerUuid)
-		if err == nil {
-			peers[peerUuid] = peer
-		}
+func parseOptionalKey(key string) (*wgtypes.Key, error) {
+	if key == "" {
+		return nil, nil
 	}
 
-	return
+	parsedKey, err := wgtypes.ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &parsedKey, nil
 }
 
-func (guard *Guard) CleanupPeers() error {
-	device, err := guard.wg.Device(guard.config.Interface.Name)
-	if err != nil {
-		return err
+// ParseEndpoint resolves and validates a host:port endpoint
+func ParseEndpoint(endpoint string) (*net.UDPAddr, error) {
+	if endpoint == "" {
+		return nil, nil
 	}
 
-	peerList, err := guard.GetRedisPeerMap()
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("unable to resolve endpoint %s", endpoint)
+	}
+	if addr.Port == 0 || addr.IP == nil || addr.IP.IsUnspecified() {
+		return nil, fmt.Errorf("endpoint must be a host:port")
 	}
 
-	for _, key := range device.Peers {
-		keyString := key.PublicKey.String()
-		uuid := peerList[keyString]
-		if uuid != "" {
-			delete(peerList, keyString)
-		} else {
-			_ = guard.SetRedisPeer(CreateRedisPeer(
-				keyString,
-				"",
-				"",
-				"",
-				guard.FormatUpdateStorage(nil, nil),
-			))
-		}
+	return addr, nil
+}
+
+func CreateGuard(conf config.Config, wg WireguardClient, store PeerStore) *Guard {
+	return &Guard{
+		config:        conf,
+		wg:            wg,
+		store:         store,
+		reconcileLock: sync.RWMutex{},
+		traffic:       map[string]*peerTraffic{},
+		watched:       map[string]watchedPeer{},
+		authLimiter:   CreateAuthLimiter(conf.Websocket.AuthLimits),
+		listeners:     map[int]func(PeerEvent){},
+		listenerLock:  sync.RWMutex{},
+		startedAt:     time.Now(),
 	}
+}
 
-	for peerKey, peerUuid := range peerList {
-		_ = guard.DeleteRedisPeer(peerUuid, peerKey)
+// groupInterface is the name of the interface the group's peers are put on
+func (guard *Guard) groupInterface(group string) (string, error) {
+	iface := guard.config.GroupInterface(group)
+	if iface == nil {
+		return "", fmt.Errorf("group %s has no interface", group)
 	}
+	return iface.Name, nil
+}
 
-	return nil
+func (guard *Guard) GetGroupPeers(group string) (peers map[string]*Peer, err error) {
+	uuids, err := guard.store.GetGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	peers = make(map[string]*Peer, len(uuids))
+
+	for _, peerUuid := range uuids {
+		peer, err := guard.GetWgPeer(peerUuid)
+		if err == nil {
+			peers[peerUuid] = peer
+		}
+	}
+
+	return
 }
 
 func (guard *Guard) FormatUpdateStorage(oldStorage map[string]string, newStorage map[string]interface{}) (storage map[string]string) {
@@ -141,283 +170,377 @@ func (guard *Guard) FormatUpdateStorage(oldStorage map[string]string, newStorage
 	return
 }
 
-func (guard *Guard) UpdatePeer(peer *Peer) (err error) {
-	if peer.Uuid == "" {
-		return fmt.Errorf("no uuid provided")
+// GroupNames lists every configured group
+func (guard *Guard) GroupNames() []string {
+	names := make([]string, 0, len(guard.config.Websocket.Groups))
+	for name := range guard.config.Websocket.Groups {
+		names = append(names, name)
 	}
+	return names
+}
 
-	publicKey, err := wgtypes.ParseKey(peer.PublicKey)
+// GroupWantsPresharedKey reports whether new peers in the group get a preshared key by default
+func (guard *Guard) GroupWantsPresharedKey(group string) bool {
+	return guard.config.Websocket.Groups[group].PresharedKey
+}
+
+func (guard *Guard) toRedisPeer(peer *Peer) (*RedisPeer, error) {
+	presharedKey, err := guard.encryptSecret(peer.PresharedKey)
 	if err != nil {
-		return fmt.Errorf("unable to verify public key")
+		return nil, err
 	}
 
-	err = guard.wg.ConfigureDevice(guard.config.Interface.Name, wgtypes.Config{
-		PrivateKey:   nil,
-		ListenPort:   nil,
-		FirewallMark: nil,
-		ReplacePeers: false,
-		Peers: []wgtypes.PeerConfig{
-			{
-				PublicKey:                   publicKey,
-				Remove:                      false,
-				UpdateOnly:                  true,
-				PresharedKey:                nil,
-				Endpoint:                    nil,
-				PersistentKeepaliveInterval: &peer.KeepAlive,
-				ReplaceAllowedIPs:           true,
-				AllowedIPs:                  peer.AllowedIPs,
-			},
-		},
-	})
+	return &RedisPeer{
+		Uuid:         peer.Uuid,
+		Interface:    peer.Interface,
+		Group:        peer.Group,
+		Name:         peer.Name,
+		Description:  peer.Description,
+		PublicKey:    peer.PublicKey,
+		PresharedKey: presharedKey,
+		Endpoint:     peer.Endpoint,
+		AllowedIPs:   peer.AllowedIPs,
+		KeepAlive:    peer.KeepAlive,
+		CreatedAt:    peer.CreatedAt,
+		ExpiresAt:    peer.ExpiresAt,
+		Disabled:     peer.Disabled,
+		Storage:      peer.Storage,
+	}, nil
+}
 
+func (guard *Guard) fromRedisPeer(redisPeer *RedisPeer) (*Peer, error) {
+	presharedKey, err := guard.decryptSecret(redisPeer.PresharedKey)
 	if err != nil {
-		return fmt.Errorf("unable to update peer configuration")
+		return nil, err
 	}
 
-	err = guard.SetRedisPeer(&RedisPeer{
-		Uuid:        peer.Uuid,
-		Group:       peer.Group,
-		Name:        peer.Name,
-		Description: peer.Description,
-		PublicKey:   peer.PublicKey,
-		Storage:     peer.Storage,
-	})
-	if err != nil {
-		return fmt.Errorf("unable to update peer configuration")
+	// Records from before multiple interfaces were supported go by their group
+	iface := redisPeer.Interface
+	if iface == "" {
+		iface, err = guard.groupInterface(redisPeer.Group)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return
+	return &Peer{
+		Uuid:          redisPeer.Uuid,
+		Interface:     iface,
+		Group:         redisPeer.Group,
+		Name:          redisPeer.Name,
+		Description:   redisPeer.Description,
+		PublicKey:     redisPeer.PublicKey,
+		PresharedKey:  presharedKey,
+		Endpoint:      redisPeer.Endpoint,
+		Storage:       redisPeer.Storage,
+		AllowedIPs:    redisPeer.AllowedIPs,
+		KeepAlive:     redisPeer.KeepAlive,
+		CreatedAt:     redisPeer.CreatedAt,
+		ExpiresAt:     redisPeer.ExpiresAt,
+		ExpiresIn:     expiresIn(redisPeer.ExpiresAt),
+		Disabled:      redisPeer.Disabled,
+		LastHandshake: time.Time{},
+		LastEndpoint:  "0.0.0.0",
+	}, nil
 }
 
-func (guard *Guard) SetPeer(peer *Peer) (err error) {
-	if peer.Uuid == "" {
-		return fmt.Errorf("no uuid provided")
+// expiresIn is how long is left until expiresAt, zero for peers that never expire
+func expiresIn(expiresAt time.Time) time.Duration {
+	if expiresAt.IsZero() {
+		return 0
 	}
+	return time.Until(expiresAt).Round(time.Second)
+}
 
+// peerConfig builds the full device configuration for a peer
+func (guard *Guard) peerConfig(peer *Peer) (wgtypes.PeerConfig, error) {
 	publicKey, err := wgtypes.ParseKey(peer.PublicKey)
 	if err != nil {
-		return fmt.Errorf("unable to verify public key")
+		return wgtypes.PeerConfig{}, fmt.Errorf("unable to verify public key")
 	}
 
-	err = guard.wg.ConfigureDevice(guard.config.Interface.Name, wgtypes.Config{
-		PrivateKey:   nil,
-		ListenPort:   nil,
-		FirewallMark: nil,
-		ReplacePeers: false,
-		Peers: []wgtypes.PeerConfig{
-			{
-				PublicKey:                   publicKey,
-				Remove:                      false,
-				UpdateOnly:                  false,
-				PresharedKey:                nil,
-				Endpoint:                    nil,
-				PersistentKeepaliveInterval: &peer.KeepAlive,
-				ReplaceAllowedIPs:           true,
-				AllowedIPs:                  peer.AllowedIPs,
-			},
-		},
-	})
-
+	presharedKey, err := parseOptionalKey(peer.PresharedKey)
 	if err != nil {
-		return fmt.Errorf("unable to update peer configuration")
+		return wgtypes.PeerConfig{}, fmt.Errorf("unable to verify preshared key")
 	}
 
-	err = guard.SetRedisPeer(&RedisPeer{
-		Uuid:        peer.Uuid,
-		Group:       peer.Group,
-		Name:        peer.Name,
-		Description: peer.Description,
-		PublicKey:   peer.PublicKey,
-		Storage:     peer.Storage,
-	})
+	endpoint, err := ParseEndpoint(peer.Endpoint)
 	if err != nil {
-		return fmt.Errorf("unable to update peer configuration")
+		return wgtypes.PeerConfig{}, err
 	}
 
-	return
+	keepAlive := peer.KeepAlive
+
+	return wgtypes.PeerConfig{
+		PublicKey:                   publicKey,
+		Remove:                      false,
+		UpdateOnly:                  false,
+		PresharedKey:                presharedKey,
+		Endpoint:                    endpoint,
+		PersistentKeepaliveInterval: &keepAlive,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  peer.AllowedIPs,
+	}, nil
 }
 
-func (guard *Guard) DeletePeer(uuid string) (err error) {
+// RotatePresharedKey gives the peer a fresh preshared key on both the device and in the store
+func (guard *Guard) RotatePresharedKey(uuid string) (*Peer, error) {
 	peer, err := guard.GetWgPeer(uuid)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	publicKey, err := wgtypes.ParseKey(peer.PublicKey)
+	peer.PresharedKey, err = GeneratePresharedKey()
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	err = guard.wg.ConfigureDevice(guard.config.Interface.Name, wgtypes.Config{
-		PrivateKey:   nil,
-		ListenPort:   nil,
-		FirewallMark: nil,
-		ReplacePeers: false,
-		Peers: []wgtypes.PeerConfig{
-			{
-				PublicKey: publicKey,
-				Remove:    true,
-			},
-		},
-	})
+	err = guard.UpdatePeer(peer)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	err = guard.DeleteRedisPeer(uuid, peer.PublicKey)
+	return peer, nil
+}
+
+func (guard *Guard) UpdatePeer(peer *Peer) (err error) {
+	guard.reconcileLock.RLock()
+	defer guard.reconcileLock.RUnlock()
+
+	if peer.Uuid == "" {
+		return fmt.Errorf("no uuid provided")
+	}
+
+	err = guard.keepAllocatedAddresses(peer)
 	if err != nil {
-		return
+		return err
 	}
 
-	return
-}
+	peerConfig, err := guard.peerConfig(peer)
+	if err != nil {
+		return err
+	}
+	peerConfig.UpdateOnly = true
 
-func (guard *Guard) GetRedisPeerMap() (peers map[string]string, err error) {
-	guard.redisRead.Lock()
-	keys, err := redis.Strings(guard.redisConn.Do("smembers", fmt.Sprintf("%s:%s", redisRoot, peerSearchPublicKey)))
+	redisPeer, err := guard.toRedisPeer(peer)
+	if err != nil {
+		return err
+	}
 
-	if err == nil {
-		peers = make(map[string]string, len(keys))
+	// A disabled peer only changes its record, enabling it puts the new settings on the device
+	if !peer.Disabled {
+		err = guard.configureDevice(peer.Interface, wgtypes.Config{
+			PrivateKey:   nil,
+			ListenPort:   nil,
+			FirewallMark: nil,
+			ReplacePeers: false,
+			Peers:        []wgtypes.PeerConfig{peerConfig},
+		})
 
-		for _, key := range keys {
-			uuidData, err := guard.redisConn.Do("get", fmt.Sprintf("%s:%s:%s", redisRoot, peerSearchPublicKey, key))
-			if err == nil {
-				uuidString, err := redis.String(uuidData, nil)
-				if err == nil {
-					peers[key] = uuidString
-				}
-			}
-			err = nil
+		if err != nil {
+			return fmt.Errorf("unable to update peer configuration")
 		}
 	}
-	guard.redisRead.Unlock()
 
+	err = guard.store.SetPeer(redisPeer)
+	if err != nil {
+		return fmt.Errorf("unable to store peer: %w", err)
+	}
+
+	peer.ExpiresIn = expiresIn(peer.ExpiresAt)
+	guard.emit(EventPeerUpdated, peer)
 	return
 }
 
-func (guard *Guard) GetRedisPeerGroup(group string) (peers []string, err error) {
-	guard.redisRead.Lock()
-	peers, err = redis.Strings(guard.redisConn.Do("smembers", fmt.Sprintf("%s:%s:%s", redisRoot, redisGroups, group)))
-	guard.redisRead.Unlock()
-
-	return
+// DisablePeer takes the peer off its interface while keeping its record, address and keys
+func (guard *Guard) DisablePeer(uuid string) (*Peer, error) {
+	return guard.setDisabled(uuid, true)
 }
 
-func (guard *Guard) DeleteRedisPeer(uuid string, publicKey string) error {
-	var oldGroup string
+// EnablePeer puts a disabled peer back on its interface exactly as it was stored
+func (guard *Guard) EnablePeer(uuid string) (*Peer, error) {
+	return guard.setDisabled(uuid, false)
+}
 
-	guard.redisWrite.Lock()
-	_, err := guard.redisConn.Do("srem", fmt.Sprintf("%s:%s", redisRoot, redisPeer), uuid)
+func (guard *Guard) setDisabled(uuid string, disabled bool) (*Peer, error) {
+	guard.reconcileLock.RLock()
+	defer guard.reconcileLock.RUnlock()
 
-	if err == nil {
-		_, err = guard.redisConn.Do("srem", fmt.Sprintf("%s:%s", redisRoot, peerSearchPublicKey), publicKey)
+	peer, err := guard.getStoredPeer(uuid)
+	if err != nil {
+		return nil, err
 	}
 
-	if err == nil {
-		guard.redisRead.Lock()
-		oldGroup, err = redis.String(guard.redisConn.Do("get", fmt.Sprintf("%s:%s:%s:group", redisRoot, redisPeer, uuid)))
-		guard.redisRead.Unlock()
+	if peer.Disabled == disabled {
+		return peer, nil
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("srem", fmt.Sprintf("%s:%s:%s", redisRoot, redisGroups, oldGroup), uuid)
+	peerConfig, err := guard.peerConfig(peer)
+	if err != nil {
+		return nil, err
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("del", fmt.Sprintf("%s:%s:%s:uuid", redisRoot, redisPeer, uuid))
+	peer.Disabled = disabled
+	redisPeer, err := guard.toRedisPeer(peer)
+	if err != nil {
+		return nil, err
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("del", fmt.Sprintf("%s:%s:%s:name", redisRoot, redisPeer, uuid))
+	removeConfig := wgtypes.PeerConfig{
+		PublicKey: peerConfig.PublicKey,
+		Remove:    true,
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("del", fmt.Sprintf("%s:%s:%s:desc", redisRoot, redisPeer, uuid))
+	deviceConfig, undoConfig := peerConfig, removeConfig
+	if disabled {
+		deviceConfig, undoConfig = removeConfig, peerConfig
 	}
 
-	if err == nil {
-		_, err = redis.String(guard.redisConn.Do("del", fmt.Sprintf("%s:%s:%s:group", redisRoot, redisPeer, uuid)))
+	err = guard.configureDevice(peer.Interface, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{deviceConfig},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to update peer configuration")
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("del", fmt.Sprintf("%s:%s:%s:publicKey", redisRoot, redisPeer, uuid))
+	err = guard.store.SetPeer(redisPeer)
+	if err != nil {
+		// Keep the device matching the record we still have
+		_ = guard.configureDevice(peer.Interface, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{undoConfig},
+		})
+		return nil, fmt.Errorf("unable to store peer: %w", err)
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("del", fmt.Sprintf("%s:%s:%s", redisRoot, peerSearchPublicKey, publicKey))
+	if disabled {
+		guard.emit(EventPeerDisabled, peer)
+	} else {
+		guard.emit(EventPeerEnabled, peer)
 	}
-	guard.redisWrite.Unlock()
 
-	return err
+	return peer, nil
 }
 
-func (guard *Guard) SetRedisPeer(peer *RedisPeer) error {
-
-	// Process what we need before we lock
-	var redisData []interface{}
-	redisData = append(redisData, fmt.Sprintf("%s:%s:%s:info", redisRoot, redisPeer, peer.Uuid))
+func (guard *Guard) SetPeer(peer *Peer) (err error) {
+	guard.reconcileLock.RLock()
+	defer guard.reconcileLock.RUnlock()
 
-	for key, value := range peer.Storage {
-		redisData = append(redisData, key, value)
+	if peer.Uuid == "" {
+		return fmt.Errorf("no uuid provided")
 	}
 
-	// Make sure we unlock before we return anything
-	guard.redisWrite.Lock()
-
-	_, err := guard.redisConn.Do("set", fmt.Sprintf("%s:%s:%s:uuid", redisRoot, redisPeer, peer.Uuid), peer.Uuid)
+	peer.Interface, err = guard.groupInterface(peer.Group)
+	if err != nil {
+		return err
+	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("set", fmt.Sprintf("%s:%s:%s:name", redisRoot, redisPeer, peer.Uuid), peer.Name)
+	// Check the peer before claiming an address for it
+	_, err = guard.peerConfig(peer)
+	if err != nil {
+		return err
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("set", fmt.Sprintf("%s:%s:%s:desc", redisRoot, redisPeer, peer.Uuid), peer.Description)
+	address, err := guard.AllocateAddress(peer.Group, peer.Uuid)
+	if err != nil {
+		return fmt.Errorf("unable to allocate address: %w", err)
+	}
+	if address != nil {
+		peer.AllowedIPs = append([]net.IPNet{*address}, peer.AllowedIPs...)
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("set", fmt.Sprintf("%s:%s:%s:publicKey", redisRoot, redisPeer, peer.Uuid), peer.PublicKey)
+	peerConfig, err := guard.peerConfig(peer)
+	if err != nil {
+		_ = guard.store.ReleaseAddresses(peer.Group, peer.Uuid)
+		return err
 	}
 
-	if err == nil {
-		guard.redisRead.Lock()
-		oldGroup, err := redis.String(guard.redisConn.Do("get", fmt.Sprintf("%s:%s:%s:group", redisRoot, redisPeer, peer.Uuid)))
-		if err == nil && oldGroup != "" {
-			_, err = guard.redisConn.Do("srem", fmt.Sprintf("%s:%s:%s", redisRoot, redisGroups, oldGroup), peer.Uuid)
-		}
-		guard.redisRead.Unlock()
+	redisPeer, err := guard.toRedisPeer(peer)
+	if err != nil {
+		_ = guard.store.ReleaseAddresses(peer.Group, peer.Uuid)
+		return err
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("set", fmt.Sprintf("%s:%s:%s:group", redisRoot, redisPeer, peer.Uuid), peer.Group)
+	err = guard.configureDevice(peer.Interface, wgtypes.Config{
+		PrivateKey:   nil,
+		ListenPort:   nil,
+		FirewallMark: nil,
+		ReplacePeers: false,
+		Peers:        []wgtypes.PeerConfig{peerConfig},
+	})
+
+	if err != nil {
+		_ = guard.store.ReleaseAddresses(peer.Group, peer.Uuid)
+		return fmt.Errorf("unable to update peer configuration")
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("hset", redisData...)
+	err = guard.store.SetPeer(redisPeer)
+	if err != nil {
+		// Don't leave a peer on the device that we have no record of
+		_ = guard.store.ReleaseAddresses(peer.Group, peer.Uuid)
+		_ = guard.configureDevice(peer.Interface, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{
+				{
+					PublicKey: peerConfig.PublicKey,
+					Remove:    true,
+				},
+			},
+		})
+		return fmt.Errorf("unable to store peer: %w", err)
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("sadd", fmt.Sprintf("%s:%s:%s", redisRoot, redisGroups, peer.Group), peer.Uuid)
+	peer.ExpiresIn = expiresIn(peer.ExpiresAt)
+	guard.watchNewPeer(peer.Uuid)
+	guard.emit(EventPeerAdded, peer)
+	return
+}
+
+func (guard *Guard) DeletePeer(uuid string) (err error) {
+	guard.reconcileLock.RLock()
+	defer guard.reconcileLock.RUnlock()
+
+	// The record alone is enough, a peer that already fell off the device still has to go
+	peer, err := guard.getStoredPeer(uuid)
+	if err != nil {
+		return
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("sadd", fmt.Sprintf("%s:%s", redisRoot, redisPeer), peer.Uuid)
+	publicKey, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		return
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("sadd", fmt.Sprintf("%s:%s", redisRoot, peerSearchPublicKey), peer.PublicKey)
+	err = guard.configureDevice(peer.Interface, wgtypes.Config{
+		PrivateKey:   nil,
+		ListenPort:   nil,
+		FirewallMark: nil,
+		ReplacePeers: false,
+		Peers: []wgtypes.PeerConfig{
+			{
+				PublicKey: publicKey,
+				Remove:    true,
+			},
+		},
+	})
+	if err != nil {
+		return
 	}
 
-	if err == nil {
-		_, err = guard.redisConn.Do("set", fmt.Sprintf("%s:%s:%s", redisRoot, peerSearchPublicKey, peer.PublicKey), peer.Uuid)
+	err = guard.store.DeletePeer(uuid, peer.PublicKey)
+	if err != nil {
+		return
 	}
 
-	guard.redisWrite.Unlock()
+	err = guard.store.ReleaseAddresses(peer.Group, uuid)
+	if err != nil {
+		return
+	}
 
-	return nil
+	guard.emit(EventPeerDeleted, peer)
+	return
 }
 
 func (guard *Guard) GetPeers() (peers map[string]*Peer, err error) {
-	peerMap, err := guard.GetRedisPeerMap()
+	peerMap, err := guard.store.GetPeerMap()
 	if err != nil {
 		return nil, err
 	}
@@ -434,103 +557,98 @@ func (guard *Guard) GetPeers() (peers map[string]*Peer, err error) {
 	return
 }
 
-func (guard *Guard) GetRedisPeer(id string) (*RedisPeer, error) {
-	// Prepare anything we need before we lock
+// RestorePeers re-applies every stored peer to its interface, used to bring back a restarted or recreated interface
+func (guard *Guard) RestorePeers() error {
+	guard.reconcileLock.Lock()
+	defer guard.reconcileLock.Unlock()
 
-	peer := RedisPeer{
-		Uuid:        "",
-		Group:       "",
-		Name:        "",
-		Description: "",
-		PublicKey:   "",
-		Storage:     map[string]string{},
+	peerMap, err := guard.store.GetPeerMap()
+	if err != nil {
+		return err
 	}
 
-	var (
-		uuid      string
-		name      string
-		desc      string
-		publicKey string
-		group     string
-		storage   map[string]string
-	)
+	peerConfigs := make(map[string][]wgtypes.PeerConfig, len(guard.config.Interfaces))
 
-	// Make sure we unlock before we return anything
-	guard.redisRead.Lock()
-	uuid, err := redis.String(guard.redisConn.Do("get", fmt.Sprintf("%s:%s:%s:uuid", redisRoot, redisPeer, id)))
-
-	if err == nil {
-		name, err = redis.String(guard.redisConn.Do("get", fmt.Sprintf("%s:%s:%s:name", redisRoot, redisPeer, id)))
-	}
-
-	if err == nil {
-		desc, err = redis.String(guard.redisConn.Do("get", fmt.Sprintf("%s:%s:%s:desc", redisRoot, redisPeer, id)))
+	for _, peerUuid := range peerMap {
+		peer, err := guard.getStoredPeer(peerUuid)
+		if err == nil && peer.Disabled {
+			continue
+		}
+		if err == nil {
+			var peerConfig wgtypes.PeerConfig
+			peerConfig, err = guard.peerConfig(peer)
+			peerConfigs[peer.Interface] = append(peerConfigs[peer.Interface], peerConfig)
+		}
+		if err != nil {
+			fmt.Printf("Unable to restore peer %s: %s\n", peerUuid, err)
+		}
 	}
 
-	if err == nil {
-		publicKey, err = redis.String(guard.redisConn.Do("get", fmt.Sprintf("%s:%s:%s:publicKey", redisRoot, redisPeer, id)))
-	}
+	for iface, configs := range peerConfigs {
+		err = guard.configureDevice(iface, wgtypes.Config{
+			ReplacePeers: false,
+			Peers:        configs,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to restore peers to %s: %w", iface, err)
+		}
 
-	if err == nil {
-		group, err = redis.String(guard.redisConn.Do("get", fmt.Sprintf("%s:%s:%s:group", redisRoot, redisPeer, id)))
+		fmt.Printf("Restored %d peers to %s\n", len(configs), iface)
 	}
 
-	if err == nil {
-		storage, err = redis.StringMap(guard.redisConn.Do("hgetall", fmt.Sprintf("%s:%s:%s:info", redisRoot, redisPeer, peer.Uuid)))
-	}
-	guard.redisRead.Unlock()
+	return nil
+}
 
-	// Return an error or update and return the peer
-	if err != nil {
+// getStoredPeer reads a peer from the store alone, without anything the device knows about it
+func (guard *Guard) getStoredPeer(uuid string) (*Peer, error) {
+	redisPeer, err := guard.store.GetPeer(uuid)
+	if err != nil || redisPeer.Uuid == "" {
+		if err == nil {
+			err = ErrPeerNotFound
+		}
 		return nil, err
 	}
 
-	peer.Uuid = uuid
-	peer.Name = name
-	peer.Description = desc
-	peer.PublicKey = publicKey
-	peer.Group = group
-	peer.Storage = storage
-
-	return &peer, nil
+	return guard.fromRedisPeer(redisPeer)
 }
 
 func (guard *Guard) GetWgPeer(id string) (*Peer, error) {
-	device, err := guard.wg.Device(guard.config.Interface.Name)
+	peer, err := guard.getStoredPeer(id)
 	if err != nil {
 		return nil, err
 	}
 
-	redisPeer, err := guard.GetRedisPeer(id)
-	if err != nil || redisPeer.Uuid == "" {
-		if err == nil || err == redis.ErrNil {
-			err = fmt.Errorf("unable to find peer")
-		}
+	// A disabled peer isn't meant to be on the device, the record is all there is
+	if peer.Disabled {
+		return peer, nil
+	}
+
+	peerKey, _ := wgtypes.ParseKey(peer.PublicKey)
+
+	device, err := guard.device(peer.Interface)
+	if err != nil {
 		return nil, err
 	}
-	redisKey, _ := wgtypes.ParseKey(redisPeer.PublicKey)
 
-	for _, peer := range device.Peers {
-		if peer.PublicKey == redisKey {
-			var endpoint = "0.0.0.0"
-			if peer.Endpoint != nil {
-				endpoint = peer.Endpoint.IP.String()
+	for _, devicePeer := range device.Peers {
+		if devicePeer.PublicKey == peerKey {
+			if devicePeer.Endpoint != nil {
+				peer.LastEndpoint = devicePeer.Endpoint.IP.String()
+			}
+			peer.LastHandshake = devicePeer.LastHandshakeTime
+			peer.ReceiveBytes = devicePeer.ReceiveBytes
+			peer.TransmitBytes = devicePeer.TransmitBytes
+
+			// Records from before allowedIPs were stored only have them on the device
+			if len(peer.AllowedIPs) == 0 {
+				peer.AllowedIPs = devicePeer.AllowedIPs
+				peer.KeepAlive = devicePeer.PersistentKeepaliveInterval
 			}
 
-			return &Peer{
-				Uuid:          redisPeer.Uuid,
-				Group:         redisPeer.Group,
-				Name:          redisPeer.Name,
-				Description:   redisPeer.Description,
-				PublicKey:     redisPeer.PublicKey,
-				Storage:       redisPeer.Storage,
-				AllowedIPs:    peer.AllowedIPs,
-				KeepAlive:     peer.PersistentKeepaliveInterval,
-				LastHandshake: peer.LastHandshakeTime,
-				LastEndpoint:  endpoint,
-			}, nil
+			return peer, nil
 		}
 	}
 
-	return nil, fmt.Errorf("unable to find peer")
+	// Missing from the device, until reconcile puts it back the record still describes it
+	return peer, nil
 }
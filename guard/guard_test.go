@@ -0,0 +1,172 @@
+package guard
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/bob620/bakaguard/config"
+)
+
+// fakeWireguard keeps devices in memory and applies configs to them the way the kernel would
+type fakeWireguard struct {
+	devices map[string]*wgtypes.Device
+	lock    sync.Mutex
+}
+
+func createFakeWireguard(names ...string) *fakeWireguard {
+	wg := &fakeWireguard{devices: map[string]*wgtypes.Device{}}
+	for _, name := range names {
+		wg.devices[name] = &wgtypes.Device{Name: name}
+	}
+	return wg
+}
+
+func (wg *fakeWireguard) Device(name string) (*wgtypes.Device, error) {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+
+	device, ok := wg.devices[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	copied := *device
+	copied.Peers = append([]wgtypes.Peer(nil), device.Peers...)
+	return &copied, nil
+}
+
+func (wg *fakeWireguard) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	wg.lock.Lock()
+	defer wg.lock.Unlock()
+
+	device, ok := wg.devices[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	if cfg.PrivateKey != nil {
+		device.PrivateKey = *cfg.PrivateKey
+		device.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ReplacePeers {
+		device.Peers = nil
+	}
+
+	for _, peerConfig := range cfg.Peers {
+		index := -1
+		for i, peer := range device.Peers {
+			if peer.PublicKey == peerConfig.PublicKey {
+				index = i
+			}
+		}
+
+		if peerConfig.Remove {
+			if index >= 0 {
+				device.Peers = append(device.Peers[:index], device.Peers[index+1:]...)
+			}
+			continue
+		}
+
+		if index < 0 {
+			if peerConfig.UpdateOnly {
+				continue
+			}
+			device.Peers = append(device.Peers, wgtypes.Peer{PublicKey: peerConfig.PublicKey})
+			index = len(device.Peers) - 1
+		}
+
+		peer := &device.Peers[index]
+		if peerConfig.PresharedKey != nil {
+			peer.PresharedKey = *peerConfig.PresharedKey
+		}
+		if peerConfig.Endpoint != nil {
+			peer.Endpoint = peerConfig.Endpoint
+		}
+		if peerConfig.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *peerConfig.PersistentKeepaliveInterval
+		}
+		if peerConfig.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, peerConfig.AllowedIPs...)
+	}
+
+	return nil
+}
+
+// testConfig has one interface, wg0, with a "test" group on 10.0.0.0/29 served from 10.0.0.1
+func testConfig() config.Config {
+	return config.Config{
+		Interfaces: []*config.Interface{{Name: "wg0", Endpoint: "vpn.example.com:51820"}},
+		Websocket: &config.Websocket{
+			Groups: map[string]config.WSGroup{
+				"test": {
+					Interface: "wg0",
+					Network: config.Network{
+						IP:     "10.0.0.0",
+						Mask:   [4]byte{255, 255, 255, 248},
+						Server: "10.0.0.1",
+					},
+				},
+			},
+		},
+		SecretKey: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+	}
+}
+
+func createTestGuard(t *testing.T) (*Guard, *fakeWireguard, *MemoryStore) {
+	t.Helper()
+
+	wg := createFakeWireguard("wg0")
+	store := CreateMemoryStore()
+	return CreateGuard(testConfig(), wg, store), wg, store
+}
+
+func generatePublicKey(t *testing.T) string {
+	t.Helper()
+
+	_, publicKey, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey
+}
+
+func mustParseCIDR(t *testing.T, cidr string) net.IPNet {
+	t.Helper()
+
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *ipNet
+}
+
+func TestGetWgPeerMissingFromDevice(t *testing.T) {
+	guard, wg, _ := createTestGuard(t)
+
+	peer := CreatePeer(generatePublicKey(t), "test", "", "", 25*time.Second, []net.IPNet{mustParseCIDR(t, "192.168.5.0/24")}, map[string]string{})
+	if err := guard.SetPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The interface was restarted and hasn't been reconciled yet
+	wg.devices["wg0"] = &wgtypes.Device{Name: "wg0"}
+
+	got, err := guard.GetWgPeer(peer.Uuid)
+	if err != nil {
+		t.Fatalf("stored peer missing from the device: %s", err)
+	}
+	if got.PublicKey != peer.PublicKey || !sameIPNets(got.AllowedIPs, peer.AllowedIPs) {
+		t.Errorf("peer = %+v, want the stored record", got)
+	}
+
+	if _, err := guard.GetWgPeer("unknown"); err != ErrPeerNotFound {
+		t.Errorf("unknown peer: err = %v, want ErrPeerNotFound", err)
+	}
+}
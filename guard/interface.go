@@ -0,0 +1,283 @@
+package guard
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/bob620/bakaguard/config"
+)
+
+func runIp(args ...string) error {
+	output, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// EnsureInterfaces sets up every configured interface.
+// The secretKey is checked against every stored key first, so a bad one fails before any interface is created or changed.
+func (guard *Guard) EnsureInterfaces() error {
+	err := guard.CheckSecretKey()
+	if err != nil {
+		return err
+	}
+
+	for _, iface := range guard.config.Interfaces {
+		stored, err := guard.store.GetInterface(iface.Name)
+		if err == ErrInterfaceNotFound {
+			continue
+		}
+		if err == nil {
+			_, err = guard.decryptSecret(stored.PrivateKey)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", iface.Name, err)
+		}
+	}
+
+	for _, iface := range guard.config.Interfaces {
+		err := guard.ensureInterface(iface)
+		if err != nil {
+			return fmt.Errorf("%s: %w", iface.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ensureInterface creates the interface if it is missing and brings it to the stored configuration.
+// An existing interface with nothing stored is adopted as it is, a new one gets a freshly generated key.
+func (guard *Guard) ensureInterface(ifaceConfig *config.Interface) error {
+	name := ifaceConfig.Name
+
+	device, err := guard.device(name)
+	if os.IsNotExist(err) {
+		fmt.Println("Creating interface", name)
+
+		err = runIp("link", "add", "dev", name, "type", "wireguard")
+		if err != nil {
+			return err
+		}
+
+		device, err = guard.device(name)
+	}
+	if err != nil {
+		return err
+	}
+
+	stored, err := guard.store.GetInterface(name)
+	if err == ErrInterfaceNotFound {
+		stored = &RedisInterface{
+			Name:         name,
+			ListenPort:   ifaceConfig.ListenPort,
+			FirewallMark: ifaceConfig.FirewallMark,
+		}
+
+		privateKey := device.PrivateKey
+		if privateKey == (wgtypes.Key{}) {
+			privateKey, err = wgtypes.GeneratePrivateKey()
+			if err != nil {
+				return fmt.Errorf("unable to generate private key")
+			}
+		} else if device.ListenPort != 0 {
+			stored.ListenPort = device.ListenPort
+			stored.FirewallMark = device.FirewallMark
+		}
+
+		err = guard.saveInterface(stored, privateKey)
+		if err != nil && device.PrivateKey == (wgtypes.Key{}) {
+			// A key we can't keep would be gone on the next restart
+			return fmt.Errorf("unable to store interface key: %w", err)
+		}
+		if err != nil {
+			fmt.Println("Unable to store interface key:", err)
+			stored.PrivateKey = ""
+		}
+	} else if err != nil {
+		return err
+	}
+
+	err = guard.applyInterface(stored)
+	if err != nil {
+		return err
+	}
+
+	err = runIp("link", "set", "up", "dev", name)
+	if err != nil {
+		return err
+	}
+
+	return guard.addGroupAddresses(name)
+}
+
+// saveInterface seals the private key into iface and stores it
+func (guard *Guard) saveInterface(iface *RedisInterface, privateKey wgtypes.Key) (err error) {
+	iface.PrivateKey, err = guard.encryptSecret(privateKey.String())
+	if err != nil {
+		return
+	}
+
+	return guard.store.SetInterface(iface)
+}
+
+func (guard *Guard) applyInterface(iface *RedisInterface) error {
+	var privateKey *wgtypes.Key
+
+	if iface.PrivateKey != "" {
+		keyString, err := guard.decryptSecret(iface.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		privateKey, err = parseOptionalKey(keyString)
+		if err != nil {
+			return fmt.Errorf("unable to read interface key")
+		}
+	}
+
+	var listenPort *int
+	if iface.ListenPort != 0 {
+		listenPort = &iface.ListenPort
+	}
+
+	err := guard.configureDevice(iface.Name, wgtypes.Config{
+		PrivateKey:   privateKey,
+		ListenPort:   listenPort,
+		FirewallMark: &iface.FirewallMark,
+		ReplacePeers: false,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to configure interface")
+	}
+
+	return nil
+}
+
+// addGroupAddresses gives the interface its server address in the network of every group on it
+func (guard *Guard) addGroupAddresses(name string) error {
+	netInterface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+
+	existing, err := netInterface.Addrs()
+	if err != nil {
+		return err
+	}
+
+	for groupName, group := range guard.config.Websocket.Groups {
+		if groupInterface := guard.config.GroupInterface(groupName); groupInterface == nil || groupInterface.Name != name {
+			continue
+		}
+
+		serverIP := group.Network.ServerIP()
+		if serverIP == nil {
+			continue
+		}
+
+		address := net.IPNet{IP: serverIP, Mask: group.Network.IPNet().Mask}
+
+		found := false
+		for _, addr := range existing {
+			if addr.String() == address.String() {
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+
+		err = runIp("address", "add", address.String(), "dev", name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (guard *Guard) GetInterfaces() ([]*Interface, error) {
+	ifaces := make([]*Interface, 0, len(guard.config.Interfaces))
+
+	for _, ifaceConfig := range guard.config.Interfaces {
+		iface, err := guard.GetInterface(ifaceConfig.Name)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = append(ifaces, iface)
+	}
+
+	return ifaces, nil
+}
+
+func (guard *Guard) GetInterface(name string) (*Interface, error) {
+	if guard.config.GetInterface(name) == nil {
+		return nil, ErrInterfaceNotFound
+	}
+
+	device, err := guard.device(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Interface{
+		Name:         device.Name,
+		PublicKey:    device.PublicKey.String(),
+		ListenPort:   device.ListenPort,
+		FirewallMark: device.FirewallMark,
+		Peers:        len(device.Peers),
+	}, nil
+}
+
+// UpdateInterface changes whichever settings are given, a nil setting is left alone
+func (guard *Guard) UpdateInterface(name string, listenPort, firewallMark *int, newKey bool) (*Interface, error) {
+	if guard.config.GetInterface(name) == nil {
+		return nil, ErrInterfaceNotFound
+	}
+
+	stored, err := guard.store.GetInterface(name)
+	if err == ErrInterfaceNotFound {
+		stored = &RedisInterface{Name: name}
+	} else if err != nil {
+		return nil, err
+	}
+
+	device, err := guard.device(name)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey := device.PrivateKey
+	if newKey {
+		privateKey, err = wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate private key")
+		}
+	}
+
+	if listenPort != nil {
+		stored.ListenPort = *listenPort
+	}
+	if firewallMark != nil {
+		stored.FirewallMark = *firewallMark
+	}
+
+	// Store first, a key only the device knows about would be lost on restart
+	err = guard.saveInterface(stored, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = guard.applyInterface(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return guard.GetInterface(name)
+}
@@ -0,0 +1,115 @@
+package guard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// AllocateAddress claims the next free /32 in the group's network for uuid.
+// The network, broadcast and server addresses are never handed out.
+func (guard *Guard) AllocateAddress(group, uuid string) (*net.IPNet, error) {
+	groupSettings, ok := guard.config.Websocket.Groups[group]
+	if !ok || groupSettings.Network.IP == "" {
+		return nil, nil
+	}
+
+	network := groupSettings.Network.IPNet()
+	if network.IP == nil {
+		return nil, fmt.Errorf("group %s has an invalid network", group)
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("group %s network is too small to allocate from", group)
+	}
+
+	start := binary.BigEndian.Uint32(network.IP.Mask(network.Mask))
+	broadcast := start | ^binary.BigEndian.Uint32(network.Mask)
+
+	var server uint32
+	if serverIP := groupSettings.Network.ServerIP(); serverIP != nil {
+		server = binary.BigEndian.Uint32(serverIP)
+	}
+
+	used, err := guard.store.GetAddresses(group)
+	if err != nil {
+		return nil, err
+	}
+
+	iface, err := guard.groupInterface(group)
+	if err != nil {
+		return nil, err
+	}
+
+	// Peers added before allocation existed only have their addresses on the device
+	device, err := guard.device(iface)
+	if err != nil {
+		return nil, err
+	}
+	for _, devicePeer := range device.Peers {
+		for _, allowedIP := range devicePeer.AllowedIPs {
+			if ones, _ := allowedIP.Mask.Size(); ones == 32 && network.Contains(allowedIP.IP) {
+				used[allowedIP.IP.String()] = devicePeer.PublicKey.String()
+			}
+		}
+	}
+
+	for candidate := start + 1; candidate < broadcast; candidate++ {
+		if candidate == server {
+			continue
+		}
+
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, candidate)
+
+		if _, taken := used[ip.String()]; taken {
+			continue
+		}
+
+		// Another add may have taken it since we listed, so only the claim decides
+		claimed, err := guard.store.ClaimAddress(group, ip.String(), uuid)
+		if err != nil {
+			return nil, err
+		}
+
+		if claimed {
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free addresses left in group %s", group)
+}
+
+// keepAllocatedAddresses puts the addresses the peer holds in its group back into its allowedIPs.
+// They stay claimed until the peer is deleted, so they can't be dropped from the device before then.
+func (guard *Guard) keepAllocatedAddresses(peer *Peer) error {
+	used, err := guard.store.GetAddresses(peer.Group)
+	if err != nil {
+		return err
+	}
+
+	for ip, uuid := range used {
+		if uuid != peer.Uuid {
+			continue
+		}
+
+		address := net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)}
+		if address.IP == nil {
+			continue
+		}
+
+		found := false
+		for _, allowedIP := range peer.AllowedIPs {
+			if allowedIP.String() == address.String() {
+				found = true
+			}
+		}
+
+		if !found {
+			peer.AllowedIPs = append([]net.IPNet{address}, peer.AllowedIPs...)
+		}
+	}
+
+	return nil
+}
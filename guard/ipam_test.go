@@ -0,0 +1,125 @@
+package guard
+
+import (
+	"net"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/bob620/bakaguard/config"
+)
+
+func TestAllocateAddress(t *testing.T) {
+	guard, _, _ := createTestGuard(t)
+
+	// 10.0.0.0/29 without the network, broadcast and server addresses
+	want := []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}
+	for i, ip := range want {
+		address, err := guard.AllocateAddress("test", string(rune('a'+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address.String() != ip+"/32" {
+			t.Errorf("allocation %d = %s, want %s/32", i, address.String(), ip)
+		}
+	}
+
+	if _, err := guard.AllocateAddress("test", "full"); err == nil {
+		t.Errorf("allocated from an exhausted network")
+	}
+
+	// Released addresses are handed out again
+	if err := guard.store.ReleaseAddresses("test", "b"); err != nil {
+		t.Fatal(err)
+	}
+	address, err := guard.AllocateAddress("test", "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.String() != "10.0.0.3/32" {
+		t.Errorf("allocation after release = %s, want 10.0.0.3/32", address.String())
+	}
+}
+
+func TestAllocateAddressSkipsDeviceAddresses(t *testing.T) {
+	guard, wg, _ := createTestGuard(t)
+
+	key, err := wgtypes.ParseKey(generatePublicKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer from before allocation existed only has its address on the device
+	wg.devices["wg0"].Peers = []wgtypes.Peer{{
+		PublicKey:  key,
+		AllowedIPs: []net.IPNet{mustParseCIDR(t, "10.0.0.2/32")},
+	}}
+
+	address, err := guard.AllocateAddress("test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.String() != "10.0.0.3/32" {
+		t.Errorf("allocation = %s, want 10.0.0.3/32", address.String())
+	}
+}
+
+func TestAllocateAddressGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		network config.Network
+		wantNil bool
+		wantErr bool
+	}{
+		{"no network", config.Network{}, true, false},
+		{"too small", config.Network{IP: "10.0.1.0", Mask: [4]byte{255, 255, 255, 254}}, true, true},
+		{"invalid", config.Network{IP: "not an ip", Mask: [4]byte{255, 255, 255, 0}}, true, true},
+		{"default server", config.Network{IP: "10.0.2.0", Mask: [4]byte{255, 255, 255, 0}}, false, false},
+	}
+
+	for _, test := range tests {
+		guard, _, _ := createTestGuard(t)
+		guard.config.Websocket.Groups["other"] = config.WSGroup{Interface: "wg0", Network: test.network}
+
+		address, err := guard.AllocateAddress("other", "a")
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: err = %v, want error %t", test.name, err, test.wantErr)
+		}
+		if err == nil && (address == nil) != test.wantNil {
+			t.Errorf("%s: address = %v, want nil %t", test.name, address, test.wantNil)
+		}
+	}
+
+	// Without a configured server address the first host is the server's
+	guard, _, _ := createTestGuard(t)
+	guard.config.Websocket.Groups["other"] = config.WSGroup{Interface: "wg0", Network: tests[3].network}
+	address, err := guard.AllocateAddress("other", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.String() != "10.0.2.2/32" {
+		t.Errorf("allocation = %s, want 10.0.2.2/32", address.String())
+	}
+}
+
+func TestUpdatePeerKeepsAllocatedAddress(t *testing.T) {
+	guard, wg, _ := createTestGuard(t)
+
+	peer := CreatePeer(generatePublicKey(t), "test", "", "", 0, nil, map[string]string{})
+	if err := guard.SetPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	peer.AllowedIPs = []net.IPNet{mustParseCIDR(t, "192.168.5.0/24")}
+	if err := guard.UpdatePeer(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	device, _ := wg.Device("wg0")
+	if !sameIPNets(device.Peers[0].AllowedIPs, []net.IPNet{
+		mustParseCIDR(t, "10.0.0.2/32"),
+		mustParseCIDR(t, "192.168.5.0/24"),
+	}) {
+		t.Errorf("device allowedIPs = %v, want the allocated address kept", device.Peers[0].AllowedIPs)
+	}
+}
@@ -0,0 +1,189 @@
+package guard
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bob620/bakaguard/config"
+	"github.com/bob620/bakaguard/metrics"
+)
+
+const (
+	defaultMaxFailures = 10
+	defaultBaseBackoff = time.Second
+	defaultMaxBackoff  = time.Minute
+	defaultLockout     = 15 * time.Minute
+)
+
+// maxAddressAttempts is how many attempts one address can have in progress at once, an account can only have one.
+// Hosts behind a NAT share an address, so it isn't held to a single attempt.
+const maxAddressAttempts = 4
+
+const addressKeyPrefix = "ip:"
+
+// AddressKey is the key failures from a remote host are counted under
+func AddressKey(host string) string {
+	return addressKeyPrefix + host
+}
+
+type authFailures struct {
+	count       int
+	lastFailure time.Time
+	retryAt     time.Time
+	// attempting is how many attempts reserved for the key haven't finished yet
+	attempting int
+}
+
+// AuthLimiter tracks failed logins by address and username across every connection.
+// Each failure in a row doubles the wait before the next attempt, and maxFailures of them lock the key out.
+type AuthLimiter struct {
+	maxFailures int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	lockout     time.Duration
+	failures    map[string]*authFailures
+	lock        sync.Mutex
+}
+
+func CreateAuthLimiter(limits config.AuthLimits) *AuthLimiter {
+	limiter := &AuthLimiter{
+		maxFailures: limits.MaxFailures,
+		baseBackoff: parseLimit(limits.BaseBackoff, defaultBaseBackoff),
+		maxBackoff:  parseLimit(limits.MaxBackoff, defaultMaxBackoff),
+		lockout:     parseLimit(limits.Lockout, defaultLockout),
+		failures:    map[string]*authFailures{},
+		lock:        sync.Mutex{},
+	}
+
+	if limiter.maxFailures <= 0 {
+		limiter.maxFailures = defaultMaxFailures
+	}
+
+	return limiter
+}
+
+func parseLimit(value string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return fallback
+	}
+	return duration
+}
+
+// Reserve claims the next attempt for every key, so parallel attempts can't all get in before the first one fails.
+// ok is false if any key is backing off, with wait how long it has left, or already has as many attempts in progress as it may.
+// A reserved attempt has to be finished with Fail or Succeed.
+func (limiter *AuthLimiter) Reserve(keys ...string) (wait time.Duration, ok bool) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+	busy := false
+
+	for _, key := range keys {
+		failures, ok := limiter.failures[key]
+		if !ok {
+			continue
+		}
+
+		if failures.retryAt.After(now) && failures.retryAt.Sub(now) > wait {
+			wait = failures.retryAt.Sub(now)
+		}
+
+		maxAttempts := 1
+		if strings.HasPrefix(key, addressKeyPrefix) {
+			maxAttempts = maxAddressAttempts
+		}
+		busy = busy || failures.attempting >= maxAttempts
+	}
+
+	if wait > 0 || busy {
+		return wait, false
+	}
+
+	for _, key := range keys {
+		failures, ok := limiter.failures[key]
+		if !ok {
+			failures = &authFailures{}
+			limiter.failures[key] = failures
+		}
+		failures.attempting++
+	}
+
+	return 0, true
+}
+
+// Fail counts a failed attempt against every key, finishing the attempt reserved for them
+func (limiter *AuthLimiter) Fail(keys ...string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+	limiter.prune(now)
+
+	for _, key := range keys {
+		failures, ok := limiter.failures[key]
+		if !ok {
+			failures = &authFailures{}
+			limiter.failures[key] = failures
+		}
+
+		if failures.attempting > 0 {
+			failures.attempting--
+		}
+		failures.count++
+		failures.lastFailure = now
+
+		if failures.count >= limiter.maxFailures {
+			failures.retryAt = now.Add(limiter.lockout)
+			failures.count = 0
+
+			fmt.Printf("Locked out %s for %s after %d failed logins\n", key, limiter.lockout, limiter.maxFailures)
+			kind, _, _ := strings.Cut(key, ":")
+			metrics.AuthLockouts.WithLabelValues(kind).Inc()
+			continue
+		}
+
+		backoff := limiter.baseBackoff
+		for i := 1; i < failures.count && backoff < limiter.maxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > limiter.maxBackoff {
+			backoff = limiter.maxBackoff
+		}
+		failures.retryAt = now.Add(backoff)
+	}
+}
+
+// Succeed finishes the attempt reserved for every key and forgets the failures of the account keys among them.
+// An address keeps its failures, otherwise logging in to any account would reset the count of guesses made from it.
+func (limiter *AuthLimiter) Succeed(keys ...string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, addressKeyPrefix) {
+			delete(limiter.failures, key)
+			continue
+		}
+
+		if failures, ok := limiter.failures[key]; ok && failures.attempting > 0 {
+			failures.attempting--
+		}
+	}
+}
+
+// prune forgets keys that have been quiet for a lockout, a failure that long ago no longer counts
+func (limiter *AuthLimiter) prune(now time.Time) {
+	for key, failures := range limiter.failures {
+		if failures.attempting == 0 && now.Sub(failures.lastFailure) > limiter.lockout && now.After(failures.retryAt) {
+			delete(limiter.failures, key)
+		}
+	}
+}
+
+func (guard *Guard) AuthLimiter() *AuthLimiter {
+	return guard.authLimiter
+}
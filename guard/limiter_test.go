@@ -0,0 +1,123 @@
+package guard
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bob620/bakaguard/config"
+)
+
+func TestAuthLimiterBackoff(t *testing.T) {
+	limiter := CreateAuthLimiter(config.AuthLimits{
+		MaxFailures: 5,
+		BaseBackoff: "1s",
+		MaxBackoff:  "4s",
+		Lockout:     "1h",
+	})
+
+	// Each failure doubles the wait up to maxBackoff, the fifth locks the key out
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, time.Hour}
+	for i, backoff := range want {
+		// Pretend the previous wait has passed
+		if failures, ok := limiter.failures["ip:1.2.3.4"]; ok {
+			failures.retryAt = time.Time{}
+		}
+
+		if _, ok := limiter.Reserve("ip:1.2.3.4"); !ok {
+			t.Fatalf("failure %d: attempt refused", i+1)
+		}
+		limiter.Fail("ip:1.2.3.4")
+
+		wait, ok := limiter.Reserve("ip:1.2.3.4")
+		if ok {
+			t.Fatalf("failure %d: attempt allowed while backing off", i+1)
+		}
+		if wait > backoff || wait < backoff-time.Second {
+			t.Errorf("failure %d: wait = %s, want about %s", i+1, wait, backoff)
+		}
+	}
+}
+
+func TestAuthLimiterReserve(t *testing.T) {
+	limiter := CreateAuthLimiter(config.AuthLimits{})
+
+	tests := []struct {
+		name    string
+		keys    []string
+		allowed bool
+	}{
+		{"first attempt", []string{"ip:1.2.3.4", "user:bob"}, true},
+		{"same account in progress", []string{"ip:5.6.7.8", "user:bob"}, false},
+		{"same address, other account", []string{"ip:1.2.3.4", "user:alice"}, true},
+		{"same address again", []string{"ip:1.2.3.4", "user:carol"}, true},
+		{"same address a fourth time", []string{"ip:1.2.3.4", "user:dave"}, true},
+		{"same address past its limit", []string{"ip:1.2.3.4", "user:erin"}, false},
+		{"unrelated", []string{"ip:5.6.7.8", "user:frank"}, true},
+	}
+	for _, test := range tests {
+		wait, ok := limiter.Reserve(test.keys...)
+		if ok != test.allowed {
+			t.Errorf("%s: allowed = %t, want %t", test.name, ok, test.allowed)
+		}
+		if !ok && wait != 0 {
+			t.Errorf("%s: wait = %s, an attempt in progress isn't a backoff", test.name, wait)
+		}
+	}
+
+	limiter.Succeed("ip:1.2.3.4", "user:bob")
+	if _, ok := limiter.Reserve("ip:1.2.3.4", "user:bob"); !ok {
+		t.Errorf("attempt refused after the previous one finished")
+	}
+}
+
+func TestAuthLimiterSucceedKeepsAddressFailures(t *testing.T) {
+	limiter := CreateAuthLimiter(config.AuthLimits{MaxFailures: 10, BaseBackoff: "1ns", MaxBackoff: "1ns", Lockout: "1h"})
+	address := AddressKey("1.2.3.4")
+
+	// Guessing other accounts' passwords, logging in to our own account between each guess
+	for i := 0; i < 20; i++ {
+		time.Sleep(time.Millisecond)
+
+		victim := fmt.Sprintf("user:victim%d", i)
+		if _, ok := limiter.Reserve(address, victim); !ok {
+			if i < 10 {
+				t.Fatalf("guess %d refused before maxFailures", i+1)
+			}
+			return
+		}
+		limiter.Fail(address, victim)
+
+		if _, ok := limiter.Reserve(address, "user:mallory"); ok {
+			limiter.Succeed(address, "user:mallory")
+		}
+	}
+
+	t.Errorf("address never locked out though every guess failed")
+}
+
+func TestAuthLimiterSucceedClearsAccount(t *testing.T) {
+	limiter := CreateAuthLimiter(config.AuthLimits{MaxFailures: 10, BaseBackoff: "1ns", MaxBackoff: "1ns"})
+	keys := []string{AddressKey("1.2.3.4"), "user:bob"}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond)
+		if _, ok := limiter.Reserve(keys...); !ok {
+			t.Fatalf("failure %d: attempt refused", i+1)
+		}
+		limiter.Fail(keys...)
+	}
+
+	time.Sleep(time.Millisecond)
+	if _, ok := limiter.Reserve(keys...); !ok {
+		t.Fatal("attempt refused before maxFailures")
+	}
+	limiter.Succeed(keys...)
+
+	if _, ok := limiter.failures["user:bob"]; ok {
+		t.Errorf("account failures kept after a successful login")
+	}
+	if failures := limiter.failures[keys[0]]; failures == nil || failures.count != 3 || failures.attempting != 0 {
+		t.Errorf("address failures = %+v, want 3 counted and nothing in progress", failures)
+	}
+}
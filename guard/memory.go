@@ -0,0 +1,441 @@
+package guard
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps peers in process memory, nothing survives a restart
+type MemoryStore struct {
+	peers      map[string]*RedisPeer
+	archive    map[string]*RedisPeer
+	stale      []*StaleAction
+	traffic    map[string]map[time.Time]TrafficTotal
+	history    map[string][]*HistoryEntry
+	lastSeen   map[string]time.Time
+	sessions   map[string]Session
+	apiKeys    map[string]*ApiKey
+	audit      []*AuditEntry
+	addresses  map[string]map[string]string
+	interfaces map[string]RedisInterface
+	lock       sync.RWMutex
+}
+
+func CreateMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		peers:      map[string]*RedisPeer{},
+		archive:    map[string]*RedisPeer{},
+		traffic:    map[string]map[time.Time]TrafficTotal{},
+		history:    map[string][]*HistoryEntry{},
+		lastSeen:   map[string]time.Time{},
+		sessions:   map[string]Session{},
+		apiKeys:    map[string]*ApiKey{},
+		addresses:  map[string]map[string]string{},
+		interfaces: map[string]RedisInterface{},
+		lock:       sync.RWMutex{},
+	}
+}
+
+func copyRedisPeer(peer *RedisPeer) *RedisPeer {
+	storage := make(map[string]string, len(peer.Storage))
+	for key, value := range peer.Storage {
+		storage[key] = value
+	}
+
+	newPeer := *peer
+	newPeer.Storage = storage
+	newPeer.AllowedIPs = append([]net.IPNet(nil), peer.AllowedIPs...)
+	return &newPeer
+}
+
+func (store *MemoryStore) SetPeer(peer *RedisPeer) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.peers[peer.Uuid] = copyRedisPeer(peer)
+	return nil
+}
+
+func (store *MemoryStore) GetPeer(uuid string) (*RedisPeer, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	peer, ok := store.peers[uuid]
+	if !ok {
+		return nil, ErrPeerNotFound
+	}
+
+	return copyRedisPeer(peer), nil
+}
+
+func (store *MemoryStore) DeletePeer(uuid, publicKey string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.peers, uuid)
+	delete(store.traffic, uuid)
+	delete(store.history, uuid)
+	delete(store.lastSeen, uuid)
+	return nil
+}
+
+func (store *MemoryStore) GetPeerMap() (map[string]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	peers := make(map[string]string, len(store.peers))
+	for uuid, peer := range store.peers {
+		peers[peer.PublicKey] = uuid
+	}
+
+	return peers, nil
+}
+
+func (store *MemoryStore) GetGroup(group string) ([]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	var uuids []string
+	for uuid, peer := range store.peers {
+		if peer.Group == group {
+			uuids = append(uuids, uuid)
+		}
+	}
+
+	return uuids, nil
+}
+
+func (store *MemoryStore) GetAddresses(group string) (map[string]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	addresses := make(map[string]string, len(store.addresses[group]))
+	for ip, uuid := range store.addresses[group] {
+		addresses[ip] = uuid
+	}
+
+	return addresses, nil
+}
+
+func (store *MemoryStore) ClaimAddress(group, ip, uuid string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.addresses[group] == nil {
+		store.addresses[group] = map[string]string{}
+	}
+
+	if _, taken := store.addresses[group][ip]; taken {
+		return false, nil
+	}
+
+	store.addresses[group][ip] = uuid
+	return true, nil
+}
+
+func (store *MemoryStore) ReleaseAddresses(group, uuid string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for ip, owner := range store.addresses[group] {
+		if owner == uuid {
+			delete(store.addresses[group], ip)
+		}
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) SetInterface(iface *RedisInterface) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.interfaces[iface.Name] = *iface
+	return nil
+}
+
+func (store *MemoryStore) GetInterface(name string) (*RedisInterface, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	iface, ok := store.interfaces[name]
+	if !ok {
+		return nil, ErrInterfaceNotFound
+	}
+
+	return &iface, nil
+}
+
+func (store *MemoryStore) ArchivePeer(peer *RedisPeer) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.archive[peer.Uuid] = copyRedisPeer(peer)
+	return nil
+}
+
+func (store *MemoryStore) RecordStaleAction(action *StaleAction) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	recorded := *action
+	store.stale = append([]*StaleAction{&recorded}, store.stale...)
+	if len(store.stale) > maxStaleActions {
+		store.stale = store.stale[:maxStaleActions]
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) GetStaleActions(limit int) ([]*StaleAction, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	if limit > len(store.stale) {
+		limit = len(store.stale)
+	}
+
+	actions := make([]*StaleAction, 0, limit)
+	for _, action := range store.stale[:limit] {
+		recorded := *action
+		actions = append(actions, &recorded)
+	}
+
+	return actions, nil
+}
+
+func (store *MemoryStore) AddTraffic(uuid string, hour time.Time, receive, transmit int64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.traffic[uuid] == nil {
+		store.traffic[uuid] = map[time.Time]TrafficTotal{}
+	}
+
+	total := store.traffic[uuid][hour]
+	total.Receive += receive
+	total.Transmit += transmit
+	store.traffic[uuid][hour] = total
+
+	return nil
+}
+
+func (store *MemoryStore) GetTraffic(uuid string, since time.Time) (receive, transmit int64, err error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for hour, total := range store.traffic[uuid] {
+		if !hour.Before(since) {
+			receive += total.Receive
+			transmit += total.Transmit
+		}
+	}
+
+	return
+}
+
+func (store *MemoryStore) PruneTraffic(uuid string, before time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for hour := range store.traffic[uuid] {
+		if hour.Before(before) {
+			delete(store.traffic[uuid], hour)
+		}
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) SetLastSeen(uuid string, lastSeen time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.lastSeen[uuid] = lastSeen
+	return nil
+}
+
+func (store *MemoryStore) GetLastSeen(uuid string) (time.Time, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.lastSeen[uuid], nil
+}
+
+func (store *MemoryStore) AddHistory(uuid string, entry *HistoryEntry) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	recorded := *entry
+	store.history[uuid] = append([]*HistoryEntry{&recorded}, store.history[uuid]...)
+	if len(store.history[uuid]) > maxHistory {
+		store.history[uuid] = store.history[uuid][:maxHistory]
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) GetHistory(uuid string, limit int) ([]*HistoryEntry, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	history := store.history[uuid]
+	if limit > len(history) {
+		limit = len(history)
+	}
+
+	entries := make([]*HistoryEntry, 0, limit)
+	for _, entry := range history[:limit] {
+		recorded := *entry
+		entries = append(entries, &recorded)
+	}
+
+	return entries, nil
+}
+
+func (store *MemoryStore) SetSession(tokenHash string, session *Session) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// Drop whatever has expired since, nothing else clears them out
+	now := time.Now()
+	for hash, stored := range store.sessions {
+		if now.After(stored.ExpiresAt) {
+			delete(store.sessions, hash)
+		}
+	}
+
+	store.sessions[tokenHash] = *session
+	return nil
+}
+
+func (store *MemoryStore) GetSession(tokenHash string) (*Session, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	session, ok := store.sessions[tokenHash]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+
+	return &session, nil
+}
+
+func (store *MemoryStore) DeleteSession(tokenHash string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.sessions, tokenHash)
+	return nil
+}
+
+func copyApiKey(key *ApiKey) *ApiKey {
+	groups := make(map[string][]string, len(key.Groups))
+	for group, scopes := range key.Groups {
+		groups[group] = append([]string(nil), scopes...)
+	}
+
+	newKey := *key
+	newKey.Groups = groups
+	return &newKey
+}
+
+func (store *MemoryStore) SetApiKey(key *ApiKey) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.apiKeys[key.Id] = copyApiKey(key)
+	return nil
+}
+
+func (store *MemoryStore) GetApiKey(id string) (*ApiKey, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	key, ok := store.apiKeys[id]
+	if !ok {
+		return nil, ErrApiKeyNotFound
+	}
+
+	return copyApiKey(key), nil
+}
+
+func (store *MemoryStore) GetApiKeyByHash(keyHash string) (*ApiKey, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for _, key := range store.apiKeys {
+		if key.Hash == keyHash {
+			return copyApiKey(key), nil
+		}
+	}
+
+	return nil, ErrApiKeyNotFound
+}
+
+func (store *MemoryStore) GetApiKeys() ([]*ApiKey, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	keys := make([]*ApiKey, 0, len(store.apiKeys))
+	for _, key := range store.apiKeys {
+		keys = append(keys, copyApiKey(key))
+	}
+
+	return keys, nil
+}
+
+func (store *MemoryStore) TouchApiKey(id string, lastUsed time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	key, ok := store.apiKeys[id]
+	if !ok {
+		return ErrApiKeyNotFound
+	}
+
+	key.LastUsed = lastUsed
+	return nil
+}
+
+func (store *MemoryStore) DeleteApiKey(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.apiKeys[id]; !ok {
+		return ErrApiKeyNotFound
+	}
+
+	delete(store.apiKeys, id)
+	return nil
+}
+
+func (store *MemoryStore) AddAudit(entry *AuditEntry) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	recorded := *entry
+	store.audit = append(store.audit, &recorded)
+	return nil
+}
+
+func (store *MemoryStore) QueryAudit(filter AuditFilter) ([]*AuditEntry, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	entries := []*AuditEntry{}
+	for i := len(store.audit) - 1; i >= 0; i-- {
+		if !filter.Matches(store.audit[i]) {
+			continue
+		}
+
+		recorded := *store.audit[i]
+		entries = append(entries, &recorded)
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+	}
+
+	return entries, nil
+}
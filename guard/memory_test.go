@@ -0,0 +1,295 @@
+package guard
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorePeers(t *testing.T) {
+	store := CreateMemoryStore()
+
+	peers := []*RedisPeer{
+		{Uuid: "a", Group: "one", PublicKey: "keyA", Storage: map[string]string{"mac": "aa"}},
+		{Uuid: "b", Group: "one", PublicKey: "keyB", Storage: map[string]string{}},
+		{Uuid: "c", Group: "two", PublicKey: "keyC", Storage: map[string]string{}},
+	}
+	for _, peer := range peers {
+		if err := store.SetPeer(peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		group string
+		want  []string
+	}{
+		{"one", []string{"a", "b"}},
+		{"two", []string{"c"}},
+		{"none", nil},
+	}
+	for _, test := range tests {
+		got, err := store.GetGroup(test.group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if len(got) != len(test.want) {
+			t.Errorf("GetGroup(%q) = %v, want %v", test.group, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("GetGroup(%q) = %v, want %v", test.group, got, test.want)
+			}
+		}
+	}
+
+	peerMap, err := store.GetPeerMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range peers {
+		if peerMap[peer.PublicKey] != peer.Uuid {
+			t.Errorf("GetPeerMap()[%q] = %q, want %q", peer.PublicKey, peerMap[peer.PublicKey], peer.Uuid)
+		}
+	}
+
+	// Stored peers are copies, changing what was passed in or handed back doesn't touch the store
+	peers[0].Storage["mac"] = "changed"
+	got, err := store.GetPeer("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Storage["mac"] != "aa" {
+		t.Errorf("stored storage changed through the caller's map: %q", got.Storage["mac"])
+	}
+	got.Storage["mac"] = "changed"
+	if again, _ := store.GetPeer("a"); again.Storage["mac"] != "aa" {
+		t.Errorf("stored storage changed through a returned map: %q", again.Storage["mac"])
+	}
+
+	// Moving a peer between groups takes it out of the old one
+	moved := *peers[1]
+	moved.Group = "two"
+	if err = store.SetPeer(&moved); err != nil {
+		t.Fatal(err)
+	}
+	if group, _ := store.GetGroup("one"); len(group) != 1 || group[0] != "a" {
+		t.Errorf("GetGroup(one) after move = %v, want [a]", group)
+	}
+
+	if err = store.DeletePeer("a", "keyA"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.GetPeer("a"); err != ErrPeerNotFound {
+		t.Errorf("GetPeer of deleted peer: err = %v, want ErrPeerNotFound", err)
+	}
+	if peerMap, _ = store.GetPeerMap(); peerMap["keyA"] != "" {
+		t.Errorf("deleted peer still in peer map")
+	}
+}
+
+func TestMemoryStoreAddresses(t *testing.T) {
+	store := CreateMemoryStore()
+
+	tests := []struct {
+		ip, uuid string
+		claimed  bool
+	}{
+		{"10.0.0.2", "a", true},
+		{"10.0.0.3", "b", true},
+		{"10.0.0.2", "b", false},
+		{"10.0.0.4", "a", true},
+	}
+	for _, test := range tests {
+		claimed, err := store.ClaimAddress("test", test.ip, test.uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != test.claimed {
+			t.Errorf("ClaimAddress(%s, %s) = %t, want %t", test.ip, test.uuid, claimed, test.claimed)
+		}
+	}
+
+	if err := store.ReleaseAddresses("test", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := store.GetAddresses("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses["10.0.0.3"] != "b" {
+		t.Errorf("GetAddresses after release = %v, want only 10.0.0.3 held by b", addresses)
+	}
+
+	// Groups are separate pools
+	if claimed, _ := store.ClaimAddress("other", "10.0.0.3", "c"); !claimed {
+		t.Errorf("address taken in one group couldn't be claimed in another")
+	}
+}
+
+func TestMemoryStoreSessions(t *testing.T) {
+	store := CreateMemoryStore()
+
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		found     bool
+	}{
+		{"live", time.Now().Add(time.Hour), true},
+		{"expired", time.Now().Add(-time.Second), false},
+	}
+	for _, test := range tests {
+		err := store.SetSession(test.name, &Session{Username: test.name, ExpiresAt: test.expiresAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.GetSession(test.name)
+		if found := err == nil; found != test.found {
+			t.Errorf("GetSession(%s) found = %t, want %t", test.name, found, test.found)
+		}
+	}
+
+	if err := store.DeleteSession("live"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSession("live"); err != ErrSessionNotFound {
+		t.Errorf("GetSession after delete: err = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestMemoryStoreHistoryAndTraffic(t *testing.T) {
+	store := CreateMemoryStore()
+	now := time.Now().Truncate(time.Hour)
+
+	for i := 0; i < maxHistory+10; i++ {
+		err := store.AddHistory("a", &HistoryEntry{Time: now.Add(time.Duration(i) * time.Second), Type: EventPeerOnline})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := store.GetHistory("a", maxHistory*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != maxHistory {
+		t.Errorf("kept %d history entries, want %d", len(history), maxHistory)
+	}
+	if !history[0].Time.After(history[1].Time) {
+		t.Errorf("history isn't newest first")
+	}
+
+	totals := []struct {
+		hour              time.Time
+		receive, transmit int64
+	}{
+		{now.Add(-48 * time.Hour), 100, 10},
+		{now.Add(-time.Hour), 20, 2},
+		{now, 3, 1},
+		{now, 3, 1},
+	}
+	for _, total := range totals {
+		if err = store.AddTraffic("a", total.hour, total.receive, total.transmit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	receive, transmit, err := store.GetTraffic("a", now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receive != 26 || transmit != 4 {
+		t.Errorf("GetTraffic over a day = %d/%d, want 26/4", receive, transmit)
+	}
+
+	if err = store.PruneTraffic("a", now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if receive, _, _ = store.GetTraffic("a", time.Time{}); receive != 26 {
+		t.Errorf("GetTraffic after prune = %d, want 26", receive)
+	}
+
+	// Deleting the peer takes its history, traffic and last seen with it
+	if err = store.SetLastSeen("a", now); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.DeletePeer("a", "keyA"); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ = store.GetHistory("a", 10); len(history) != 0 {
+		t.Errorf("history kept after delete")
+	}
+	if receive, _, _ = store.GetTraffic("a", time.Time{}); receive != 0 {
+		t.Errorf("traffic kept after delete")
+	}
+	if lastSeen, _ := store.GetLastSeen("a"); !lastSeen.IsZero() {
+		t.Errorf("last seen kept after delete")
+	}
+}
+
+func TestMemoryStoreAudit(t *testing.T) {
+	store := CreateMemoryStore()
+	start := time.Now()
+
+	entries := []*AuditEntry{
+		{Time: start, Identity: "admin", Uuid: "a"},
+		{Time: start.Add(time.Minute), Identity: "user:bob", Uuid: "b"},
+		{Time: start.Add(2 * time.Minute), Identity: "admin", Uuid: "b"},
+	}
+	for _, entry := range entries {
+		if err := store.AddAudit(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   int
+	}{
+		{"everything", AuditFilter{}, 3},
+		{"identity", AuditFilter{Identity: "admin"}, 2},
+		{"uuid", AuditFilter{Uuid: "b"}, 2},
+		{"since", AuditFilter{Since: start.Add(time.Minute)}, 2},
+		{"until", AuditFilter{Until: start}, 1},
+		{"limit", AuditFilter{Limit: 1}, 1},
+	}
+	for _, test := range tests {
+		got, err := store.QueryAudit(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != test.want {
+			t.Errorf("%s: got %d entries, want %d", test.name, len(got), test.want)
+		}
+	}
+
+	newest, _ := store.QueryAudit(AuditFilter{Limit: 1})
+	if newest[0].Uuid != "b" || newest[0].Identity != "admin" {
+		t.Errorf("QueryAudit isn't newest first")
+	}
+}
+
+func TestMemoryStoreCopiesAllowedIPs(t *testing.T) {
+	store := CreateMemoryStore()
+
+	allowedIPs := []net.IPNet{mustParseCIDR(t, "10.0.0.2/32")}
+	if err := store.SetPeer(&RedisPeer{Uuid: "a", PublicKey: "keyA", AllowedIPs: allowedIPs}); err != nil {
+		t.Fatal(err)
+	}
+
+	allowedIPs[0] = mustParseCIDR(t, "10.0.0.3/32")
+
+	peer, err := store.GetPeer("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.AllowedIPs[0].String() != "10.0.0.2/32" {
+		t.Errorf("stored allowedIPs changed through the caller's slice: %s", peer.AllowedIPs[0].String())
+	}
+}
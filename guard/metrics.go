@@ -0,0 +1,70 @@
+package guard
+
+import (
+	"os"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/bob620/bakaguard/metrics"
+)
+
+// device reads a wireguard device, counting failures other than the device not existing
+func (guard *Guard) device(name string) (*wgtypes.Device, error) {
+	device, err := guard.wg.Device(name)
+	if err != nil && !os.IsNotExist(err) {
+		metrics.DeviceErrors.Inc()
+	}
+	return device, err
+}
+
+func (guard *Guard) configureDevice(name string, config wgtypes.Config) error {
+	err := guard.wg.ConfigureDevice(name, config)
+	if err != nil {
+		metrics.DeviceErrors.Inc()
+	}
+	return err
+}
+
+// MetricsSnapshot reads every interface and the peers on it for the metrics endpoint
+func (guard *Guard) MetricsSnapshot() ([]metrics.InterfaceStats, []metrics.PeerStats, error) {
+	peerMap, err := guard.store.GetPeerMap()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ifaces := make([]metrics.InterfaceStats, 0, len(guard.config.Interfaces))
+	peers := make([]metrics.PeerStats, 0, len(peerMap))
+
+	for _, iface := range guard.config.Interfaces {
+		device, err := guard.device(iface.Name)
+		if err != nil {
+			continue
+		}
+
+		ifaces = append(ifaces, metrics.InterfaceStats{Name: iface.Name, Peers: len(device.Peers)})
+
+		for _, devicePeer := range device.Peers {
+			stats := metrics.PeerStats{
+				Interface:     iface.Name,
+				LastHandshake: devicePeer.LastHandshakeTime,
+				ReceiveBytes:  devicePeer.ReceiveBytes,
+				TransmitBytes: devicePeer.TransmitBytes,
+			}
+
+			// Peers without a record yet are told apart by their key
+			stats.Name = devicePeer.PublicKey.String()
+
+			if uuid, ok := peerMap[devicePeer.PublicKey.String()]; ok {
+				stats.Uuid = uuid
+				if redisPeer, err := guard.store.GetPeer(uuid); err == nil {
+					stats.Group = redisPeer.Group
+					stats.Name = redisPeer.Name
+				}
+			}
+
+			peers = append(peers, stats)
+		}
+	}
+
+	return ifaces, peers, nil
+}
@@ -0,0 +1,255 @@
+package guard
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type ReconcileResult struct {
+	Time time.Time `json:"time"`
+	// Adopted peers were on the device with no record, they get a blank one
+	Adopted []string `json:"adopted"`
+	// Restored peers had a record but were missing from the device
+	Restored []string `json:"restored"`
+	// Corrected peers had device settings that drifted from their record, or were on the device while disabled
+	Corrected []string `json:"corrected"`
+	// Backfilled records were written before allowedIPs and interfaces were stored and took them from the device
+	Backfilled []string `json:"backfilled"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// StartReconciler reconciles every interval until the process exits
+func (guard *Guard) StartReconciler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			guard.Reconcile()
+		}
+	}()
+}
+
+func (guard *Guard) LastReconcile() *ReconcileResult {
+	return guard.lastReconcile.Load()
+}
+
+// Reconcile converges the device and the store, logging and returning every correction made.
+// The store is the source of truth, a peer missing from the device is put back and its record is never deleted:
+// a recreated interface comes back empty, and treating that as every peer being removed would lose them for good.
+func (guard *Guard) Reconcile() *ReconcileResult {
+	// Peer writes touch the device before the store, so they can't run while we compare the two
+	guard.reconcileLock.Lock()
+	defer guard.reconcileLock.Unlock()
+
+	result := &ReconcileResult{
+		Time:       time.Now(),
+		Adopted:    []string{},
+		Restored:   []string{},
+		Corrected:  []string{},
+		Backfilled: []string{},
+	}
+
+	err := guard.reconcile(result)
+	if err != nil {
+		fmt.Println("Reconcile failed:", err)
+		result.Error = err.Error()
+	}
+
+	guard.lastReconcile.Store(result)
+	return result
+}
+
+func (guard *Guard) reconcile(result *ReconcileResult) error {
+	peerList, err := guard.store.GetPeerMap()
+	if err != nil {
+		return err
+	}
+
+	var deviceErr error
+	unreachable := map[string]struct{}{}
+
+	for _, iface := range guard.config.Interfaces {
+		err = guard.reconcileDevice(iface.Name, peerList, result)
+		if err != nil {
+			fmt.Printf("Unable to reconcile %s: %s\n", iface.Name, err)
+			unreachable[iface.Name] = struct{}{}
+			deviceErr = err
+		}
+	}
+
+	// Whatever is left had a record but wasn't on any device
+	for _, peerUuid := range peerList {
+		peer, err := guard.getStoredPeer(peerUuid)
+		if err == nil {
+			if _, skip := unreachable[peer.Interface]; skip || peer.Disabled {
+				continue
+			}
+
+			var peerConfig wgtypes.PeerConfig
+			peerConfig, err = guard.peerConfig(peer)
+			if err == nil {
+				err = guard.configureDevice(peer.Interface, wgtypes.Config{
+					Peers: []wgtypes.PeerConfig{peerConfig},
+				})
+			}
+		}
+		if err != nil {
+			fmt.Printf("Unable to restore missing peer %s: %s\n", peerUuid, err)
+			continue
+		}
+
+		fmt.Printf("Restored peer %s to %s, it was missing from the device\n", peerUuid, peer.Interface)
+		result.Restored = append(result.Restored, peerUuid)
+	}
+
+	return deviceErr
+}
+
+// reconcileDevice adopts and corrects the peers on one device, removing every peer it finds from peerList
+func (guard *Guard) reconcileDevice(iface string, peerList map[string]string, result *ReconcileResult) error {
+	device, err := guard.device(iface)
+	if err != nil {
+		return err
+	}
+
+	for _, devicePeer := range device.Peers {
+		keyString := devicePeer.PublicKey.String()
+		uuid := peerList[keyString]
+
+		if uuid == "" {
+			redisPeer := CreateRedisPeer(
+				keyString,
+				"",
+				"",
+				"",
+				guard.FormatUpdateStorage(nil, nil),
+			)
+			redisPeer.Interface = iface
+			redisPeer.AllowedIPs = devicePeer.AllowedIPs
+			redisPeer.KeepAlive = devicePeer.PersistentKeepaliveInterval
+
+			err = guard.store.SetPeer(redisPeer)
+			if err != nil {
+				fmt.Printf("Unable to adopt unknown peer %s: %s\n", keyString, err)
+				continue
+			}
+
+			fmt.Printf("Adopted unknown peer %s on %s as %s\n", keyString, iface, redisPeer.Uuid)
+			result.Adopted = append(result.Adopted, redisPeer.Uuid)
+			continue
+		}
+
+		delete(peerList, keyString)
+
+		redisPeer, err := guard.store.GetPeer(uuid)
+		if err != nil {
+			fmt.Printf("Unable to read peer %s: %s\n", uuid, err)
+			continue
+		}
+
+		if redisPeer.Disabled {
+			err = guard.configureDevice(iface, wgtypes.Config{
+				Peers: []wgtypes.PeerConfig{
+					{
+						PublicKey: devicePeer.PublicKey,
+						Remove:    true,
+					},
+				},
+			})
+			if err != nil {
+				fmt.Printf("Unable to remove disabled peer %s: %s\n", uuid, err)
+				continue
+			}
+
+			fmt.Printf("Removed disabled peer %s from %s\n", uuid, iface)
+			result.Corrected = append(result.Corrected, uuid)
+			continue
+		}
+
+		if redisPeer.Interface == "" || (len(redisPeer.AllowedIPs) == 0 && len(devicePeer.AllowedIPs) > 0) {
+			redisPeer.Interface = iface
+			if len(redisPeer.AllowedIPs) == 0 {
+				redisPeer.AllowedIPs = devicePeer.AllowedIPs
+				redisPeer.KeepAlive = devicePeer.PersistentKeepaliveInterval
+			}
+
+			err = guard.store.SetPeer(redisPeer)
+			if err != nil {
+				fmt.Printf("Unable to backfill peer %s: %s\n", uuid, err)
+				continue
+			}
+
+			fmt.Printf("Backfilled peer %s from %s\n", uuid, iface)
+			result.Backfilled = append(result.Backfilled, uuid)
+		}
+
+		corrected, err := guard.correctPeer(iface, redisPeer, devicePeer)
+		if err != nil {
+			fmt.Printf("Unable to correct peer %s: %s\n", uuid, err)
+			continue
+		}
+		if corrected {
+			fmt.Printf("Corrected drifted peer %s\n", uuid)
+			result.Corrected = append(result.Corrected, uuid)
+		}
+	}
+
+	return nil
+}
+
+// correctPeer re-applies the stored settings of a peer if the device no longer matches them
+func (guard *Guard) correctPeer(iface string, redisPeer *RedisPeer, devicePeer wgtypes.Peer) (bool, error) {
+	peer, err := guard.fromRedisPeer(redisPeer)
+	if err != nil {
+		return false, err
+	}
+
+	peerConfig, err := guard.peerConfig(peer)
+	if err != nil {
+		return false, err
+	}
+
+	drifted := devicePeer.PersistentKeepaliveInterval != peer.KeepAlive ||
+		!sameIPNets(devicePeer.AllowedIPs, peer.AllowedIPs) ||
+		(peerConfig.PresharedKey != nil && *peerConfig.PresharedKey != devicePeer.PresharedKey)
+
+	if !drifted {
+		return false, nil
+	}
+
+	// A roaming peer's endpoint is expected to move, only the configured settings are put back
+	peerConfig.UpdateOnly = true
+	peerConfig.Endpoint = nil
+
+	err = guard.configureDevice(iface, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peerConfig},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func sameIPNets(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	seen := make(map[string]struct{}, len(a))
+	for _, ipNet := range a {
+		seen[ipNet.String()] = struct{}{}
+	}
+
+	for _, ipNet := range b {
+		if _, ok := seen[ipNet.String()]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,82 @@
+package guard
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestReconcileRestoresRecreatedInterface(t *testing.T) {
+	guard, wg, store := createTestGuard(t)
+
+	peers := make([]*Peer, 3)
+	for i := range peers {
+		peers[i] = CreatePeer(generatePublicKey(t), "test", "", "", 0, nil, map[string]string{})
+		if err := guard.SetPeer(peers[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := guard.DisablePeer(peers[2].Uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	// The interface comes back empty, as it does after a reboot or being deleted and recreated
+	wg.devices["wg0"] = &wgtypes.Device{Name: "wg0"}
+
+	result := guard.Reconcile()
+	if result.Error != "" {
+		t.Fatal(result.Error)
+	}
+	if len(result.Restored) != 2 {
+		t.Errorf("restored %v, want the 2 enabled peers", result.Restored)
+	}
+
+	// Every record survives, the disabled one included, with its address still claimed
+	for _, peer := range peers {
+		if _, err := store.GetPeer(peer.Uuid); err != nil {
+			t.Errorf("record of %s lost: %s", peer.Uuid, err)
+		}
+	}
+
+	addresses, _ := store.GetAddresses("test")
+	if len(addresses) != len(peers) {
+		t.Errorf("%d addresses claimed after reconcile, want %d", len(addresses), len(peers))
+	}
+
+	device, _ := wg.Device("wg0")
+	if len(device.Peers) != 2 {
+		t.Errorf("%d peers on the device after reconcile, want 2", len(device.Peers))
+	}
+	for _, devicePeer := range device.Peers {
+		if devicePeer.PublicKey.String() == peers[2].PublicKey {
+			t.Errorf("disabled peer put back on the device")
+		}
+	}
+
+	// A second pass has nothing left to do
+	result = guard.Reconcile()
+	if len(result.Restored)+len(result.Adopted)+len(result.Corrected) != 0 {
+		t.Errorf("second reconcile changed things: %+v", result)
+	}
+}
+
+func TestReconcileAdoptsUnknownPeers(t *testing.T) {
+	guard, wg, store := createTestGuard(t)
+
+	key, err := wgtypes.ParseKey(generatePublicKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.devices["wg0"].Peers = []wgtypes.Peer{{PublicKey: key}}
+
+	result := guard.Reconcile()
+	if len(result.Adopted) != 1 {
+		t.Fatalf("adopted %v, want 1 peer", result.Adopted)
+	}
+
+	peerMap, _ := store.GetPeerMap()
+	if peerMap[key.String()] != result.Adopted[0] {
+		t.Errorf("adopted peer has no record")
+	}
+}
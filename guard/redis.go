@@ -0,0 +1,925 @@
+package guard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/bob620/bakaguard/config"
+	"github.com/bob620/bakaguard/metrics"
+)
+
+const redisRoot = "bakaguard"
+const redisPeer = "peers"
+const peerSearchPublicKey = "search:publicKey"
+const redisGroups = "groups"
+const redisAddresses = "addresses"
+const redisInterfaces = "interfaces"
+const redisArchive = "archive"
+const redisStaleActions = "stale:actions"
+const redisTraffic = "traffic"
+const redisHistory = "history"
+const redisSessions = "sessions"
+const redisApiKeys = "apikeys"
+const apiKeySearchHash = "search:apikeyHash"
+const redisAudit = "audit"
+
+// auditPage is how many audit entries are read from redis at a time while filtering
+const auditPage = 500
+
+type RedisStore struct {
+	pool *redis.Pool
+}
+
+// CreateRedisPool builds a pool that redials on demand, so a restarted redis only fails the requests made while it was down.
+// Once MaxActive connections are in use callers wait for one to be returned rather than failing.
+func CreateRedisPool(conf *config.Redis) *redis.Pool {
+	maxIdle := conf.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 4
+	}
+
+	return &redis.Pool{
+		MaxIdle:         maxIdle,
+		MaxActive:       conf.MaxActive,
+		IdleTimeout:     5 * time.Minute,
+		Wait:            true,
+		MaxConnLifetime: time.Hour,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", fmt.Sprintf("%s:%d", conf.Host, conf.Port),
+				redis.DialDatabase(conf.Database),
+				redis.DialConnectTimeout(5*time.Second),
+			)
+		},
+		TestOnBorrow: func(conn redis.Conn, lastUsed time.Time) error {
+			if time.Since(lastUsed) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("ping")
+			return err
+		},
+	}
+}
+
+func CreateRedisStore(pool *redis.Pool) *RedisStore {
+	return &RedisStore{
+		pool: pool,
+	}
+}
+
+// countingConn counts every failed command towards the redis error metric
+type countingConn struct {
+	redis.Conn
+}
+
+func (conn countingConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := conn.Conn.Do(commandName, args...)
+	if err != nil {
+		metrics.StoreErrors.Inc()
+	}
+	return reply, err
+}
+
+func (conn countingConn) Send(commandName string, args ...interface{}) error {
+	err := conn.Conn.Send(commandName, args...)
+	if err != nil {
+		metrics.StoreErrors.Inc()
+	}
+	return err
+}
+
+func (store *RedisStore) conn() redis.Conn {
+	return countingConn{store.pool.Get()}
+}
+
+func (store *RedisStore) GetPeerMap() (peers map[string]string, err error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("smembers", fmt.Sprintf("%s:%s", redisRoot, peerSearchPublicKey)))
+
+	if err == nil {
+		peers = make(map[string]string, len(keys))
+
+		for _, key := range keys {
+			uuidData, err := conn.Do("get", fmt.Sprintf("%s:%s:%s", redisRoot, peerSearchPublicKey, key))
+			if err == nil {
+				uuidString, err := redis.String(uuidData, nil)
+				if err == nil {
+					peers[key] = uuidString
+				}
+			}
+			err = nil
+		}
+	}
+
+	return
+}
+
+func (store *RedisStore) GetGroup(group string) (peers []string, err error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("smembers", fmt.Sprintf("%s:%s:%s", redisRoot, redisGroups, group)))
+}
+
+// optionalString reads a key that peers stored by older versions may not have
+func optionalString(conn redis.Conn, key string) (string, error) {
+	value, err := redis.String(conn.Do("get", key))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return value, err
+}
+
+type redisCommand struct {
+	name string
+	args []interface{}
+}
+
+// transaction runs every command inside a single MULTI/EXEC on conn.
+// If a watched key changed since WATCH was issued the transaction is dropped and an error returned.
+func transaction(conn redis.Conn, commands []redisCommand) error {
+	err := conn.Send("multi")
+	if err != nil {
+		return err
+	}
+
+	for _, command := range commands {
+		err = conn.Send(command.name, command.args...)
+		if err != nil {
+			_, _ = conn.Do("discard")
+			return err
+		}
+	}
+
+	reply, err := conn.Do("exec")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return fmt.Errorf("peer was modified during write")
+	}
+
+	// EXEC succeeds even if a queued command fails, so check each reply
+	replies, err := redis.Values(reply, nil)
+	if err != nil {
+		return err
+	}
+	for _, commandReply := range replies {
+		if commandErr, ok := commandReply.(redis.Error); ok {
+			return commandErr
+		}
+	}
+
+	return nil
+}
+
+// watchGroup watches the peer's group key on conn and returns the group it currently holds
+func watchGroup(conn redis.Conn, uuid string) (string, error) {
+	groupKey := fmt.Sprintf("%s:%s:%s:group", redisRoot, redisPeer, uuid)
+
+	_, err := conn.Do("watch", groupKey)
+	if err != nil {
+		return "", err
+	}
+
+	group, err := redis.String(conn.Do("get", groupKey))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	if err != nil {
+		_, _ = conn.Do("unwatch")
+	}
+
+	return group, err
+}
+
+func (store *RedisStore) DeletePeer(uuid string, publicKey string) error {
+	peerKey := fmt.Sprintf("%s:%s:%s", redisRoot, redisPeer, uuid)
+
+	conn := store.conn()
+	defer conn.Close()
+
+	oldGroup, err := watchGroup(conn, uuid)
+	if err != nil {
+		return err
+	}
+
+	return transaction(conn, []redisCommand{
+		{"srem", []interface{}{fmt.Sprintf("%s:%s", redisRoot, redisPeer), uuid}},
+		{"srem", []interface{}{fmt.Sprintf("%s:%s", redisRoot, peerSearchPublicKey), publicKey}},
+		{"srem", []interface{}{fmt.Sprintf("%s:%s:%s", redisRoot, redisGroups, oldGroup), uuid}},
+		{"del", []interface{}{
+			peerKey + ":uuid",
+			peerKey + ":name",
+			peerKey + ":desc",
+			peerKey + ":group",
+			peerKey + ":interface",
+			peerKey + ":publicKey",
+			peerKey + ":psk",
+			peerKey + ":endpoint",
+			peerKey + ":allowedIPs",
+			peerKey + ":keepAlive",
+			peerKey + ":createdAt",
+			peerKey + ":expiresAt",
+			peerKey + ":disabled",
+			peerKey + ":lastSeen",
+			peerKey + ":info",
+			fmt.Sprintf("%s:%s:%s", redisRoot, peerSearchPublicKey, publicKey),
+			fmt.Sprintf("%s:%s:%s", redisRoot, redisTraffic, uuid),
+			fmt.Sprintf("%s:%s:%s", redisRoot, redisHistory, uuid),
+		}},
+	})
+}
+
+func (store *RedisStore) SetPeer(peer *RedisPeer) error {
+
+	// Process what we need before we lock
+	peerKey := fmt.Sprintf("%s:%s:%s", redisRoot, redisPeer, peer.Uuid)
+
+	var redisData []interface{}
+	redisData = append(redisData, peerKey+":info")
+
+	for key, value := range peer.Storage {
+		redisData = append(redisData, key, value)
+	}
+
+	allowedIPs := make([]string, 0, len(peer.AllowedIPs))
+	for _, allowedIP := range peer.AllowedIPs {
+		allowedIPs = append(allowedIPs, allowedIP.String())
+	}
+
+	createdAt := ""
+	if !peer.CreatedAt.IsZero() {
+		createdAt = peer.CreatedAt.UTC().Format(time.RFC3339)
+	}
+
+	expiresAt := ""
+	if !peer.ExpiresAt.IsZero() {
+		expiresAt = peer.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+
+	commands := []redisCommand{
+		{"set", []interface{}{peerKey + ":uuid", peer.Uuid}},
+		{"set", []interface{}{peerKey + ":name", peer.Name}},
+		{"set", []interface{}{peerKey + ":desc", peer.Description}},
+		{"set", []interface{}{peerKey + ":publicKey", peer.PublicKey}},
+		{"set", []interface{}{peerKey + ":psk", peer.PresharedKey}},
+		{"set", []interface{}{peerKey + ":endpoint", peer.Endpoint}},
+		{"set", []interface{}{peerKey + ":allowedIPs", strings.Join(allowedIPs, ",")}},
+		{"set", []interface{}{peerKey + ":keepAlive", peer.KeepAlive.String()}},
+		{"set", []interface{}{peerKey + ":createdAt", createdAt}},
+		{"set", []interface{}{peerKey + ":expiresAt", expiresAt}},
+		{"set", []interface{}{peerKey + ":disabled", strconv.FormatBool(peer.Disabled)}},
+		{"set", []interface{}{peerKey + ":group", peer.Group}},
+		{"set", []interface{}{peerKey + ":interface", peer.Interface}},
+		{"del", []interface{}{peerKey + ":info"}},
+	}
+
+	if len(peer.Storage) > 0 {
+		commands = append(commands, redisCommand{"hset", redisData})
+	}
+
+	commands = append(commands,
+		redisCommand{"sadd", []interface{}{fmt.Sprintf("%s:%s:%s", redisRoot, redisGroups, peer.Group), peer.Uuid}},
+		redisCommand{"sadd", []interface{}{fmt.Sprintf("%s:%s", redisRoot, redisPeer), peer.Uuid}},
+		redisCommand{"sadd", []interface{}{fmt.Sprintf("%s:%s", redisRoot, peerSearchPublicKey), peer.PublicKey}},
+		redisCommand{"set", []interface{}{fmt.Sprintf("%s:%s:%s", redisRoot, peerSearchPublicKey, peer.PublicKey), peer.Uuid}},
+	)
+
+	conn := store.conn()
+	defer conn.Close()
+
+	oldGroup, err := watchGroup(conn, peer.Uuid)
+	if err != nil {
+		return err
+	}
+
+	if oldGroup != "" && oldGroup != peer.Group {
+		commands = append(commands, redisCommand{"srem", []interface{}{fmt.Sprintf("%s:%s:%s", redisRoot, redisGroups, oldGroup), peer.Uuid}})
+	}
+
+	return transaction(conn, commands)
+}
+
+func (store *RedisStore) GetPeer(id string) (*RedisPeer, error) {
+	peer := RedisPeer{
+		Uuid:         "",
+		Interface:    "",
+		Group:        "",
+		Name:         "",
+		Description:  "",
+		PublicKey:    "",
+		PresharedKey: "",
+		Endpoint:     "",
+		Storage:      map[string]string{},
+	}
+
+	var (
+		uuid         string
+		iface        string
+		name         string
+		desc         string
+		publicKey    string
+		presharedKey string
+		endpoint     string
+		allowedIPs   string
+		keepAlive    string
+		createdAt    string
+		expiresAt    string
+		disabled     string
+		group        string
+		storage      map[string]string
+	)
+
+	conn := store.conn()
+	defer conn.Close()
+
+	uuid, err := redis.String(conn.Do("get", fmt.Sprintf("%s:%s:%s:uuid", redisRoot, redisPeer, id)))
+
+	if err == nil {
+		name, err = redis.String(conn.Do("get", fmt.Sprintf("%s:%s:%s:name", redisRoot, redisPeer, id)))
+	}
+
+	if err == nil {
+		desc, err = redis.String(conn.Do("get", fmt.Sprintf("%s:%s:%s:desc", redisRoot, redisPeer, id)))
+	}
+
+	if err == nil {
+		publicKey, err = redis.String(conn.Do("get", fmt.Sprintf("%s:%s:%s:publicKey", redisRoot, redisPeer, id)))
+	}
+
+	if err == nil {
+		group, err = redis.String(conn.Do("get", fmt.Sprintf("%s:%s:%s:group", redisRoot, redisPeer, id)))
+	}
+
+	if err == nil {
+		iface, err = optionalString(conn, fmt.Sprintf("%s:%s:%s:interface", redisRoot, redisPeer, id))
+	}
+
+	if err == nil {
+		presharedKey, err = optionalString(conn, fmt.Sprintf("%s:%s:%s:psk", redisRoot, redisPeer, id))
+	}
+
+	if err == nil {
+		endpoint, err = optionalString(conn, fmt.Sprintf("%s:%s:%s:endpoint", redisRoot, redisPeer, id))
+	}
+
+	if err == nil {
+		allowedIPs, err = optionalString(conn, fmt.Sprintf("%s:%s:%s:allowedIPs", redisRoot, redisPeer, id))
+	}
+
+	if err == nil {
+		keepAlive, err = optionalString(conn, fmt.Sprintf("%s:%s:%s:keepAlive", redisRoot, redisPeer, id))
+	}
+
+	if err == nil {
+		createdAt, err = optionalString(conn, fmt.Sprintf("%s:%s:%s:createdAt", redisRoot, redisPeer, id))
+	}
+
+	if err == nil {
+		expiresAt, err = optionalString(conn, fmt.Sprintf("%s:%s:%s:expiresAt", redisRoot, redisPeer, id))
+	}
+
+	if err == nil {
+		disabled, err = optionalString(conn, fmt.Sprintf("%s:%s:%s:disabled", redisRoot, redisPeer, id))
+	}
+
+	if err == nil {
+		storage, err = redis.StringMap(conn.Do("hgetall", fmt.Sprintf("%s:%s:%s:info", redisRoot, redisPeer, id)))
+	}
+
+	// Return an error or update and return the peer
+	if err == redis.ErrNil {
+		return nil, ErrPeerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	peer.Uuid = uuid
+	peer.Interface = iface
+	peer.Name = name
+	peer.Description = desc
+	peer.PublicKey = publicKey
+	peer.PresharedKey = presharedKey
+	peer.Endpoint = endpoint
+	peer.KeepAlive, _ = time.ParseDuration(keepAlive)
+	peer.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	peer.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+	peer.Disabled = disabled == "true"
+
+	for _, allowedIP := range strings.Split(allowedIPs, ",") {
+		_, ipNet, err := net.ParseCIDR(allowedIP)
+		if err == nil {
+			peer.AllowedIPs = append(peer.AllowedIPs, *ipNet)
+		}
+	}
+	peer.Group = group
+	peer.Storage = storage
+
+	return &peer, nil
+}
+
+func (store *RedisStore) GetAddresses(group string) (map[string]string, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	return redis.StringMap(conn.Do("hgetall", fmt.Sprintf("%s:%s:%s", redisRoot, redisAddresses, group)))
+}
+
+func (store *RedisStore) ClaimAddress(group, ip, uuid string) (bool, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("hsetnx", fmt.Sprintf("%s:%s:%s", redisRoot, redisAddresses, group), ip, uuid))
+}
+
+func (store *RedisStore) ReleaseAddresses(group, uuid string) error {
+	conn := store.conn()
+	defer conn.Close()
+
+	addressKey := fmt.Sprintf("%s:%s:%s", redisRoot, redisAddresses, group)
+
+	addresses, err := redis.StringMap(conn.Do("hgetall", addressKey))
+	if err != nil {
+		return err
+	}
+
+	for ip, owner := range addresses {
+		if owner == uuid {
+			_, err = conn.Do("hdel", addressKey, ip)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (store *RedisStore) SetInterface(iface *RedisInterface) error {
+	conn := store.conn()
+	defer conn.Close()
+
+	_, err := conn.Do("hset", fmt.Sprintf("%s:%s:%s", redisRoot, redisInterfaces, iface.Name),
+		"privateKey", iface.PrivateKey,
+		"listenPort", iface.ListenPort,
+		"firewallMark", iface.FirewallMark,
+	)
+	return err
+}
+
+func (store *RedisStore) GetInterface(name string) (*RedisInterface, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("hgetall", fmt.Sprintf("%s:%s:%s", redisRoot, redisInterfaces, name)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrInterfaceNotFound
+	}
+
+	listenPort, _ := strconv.Atoi(values["listenPort"])
+	firewallMark, _ := strconv.Atoi(values["firewallMark"])
+
+	return &RedisInterface{
+		Name:         name,
+		PrivateKey:   values["privateKey"],
+		ListenPort:   listenPort,
+		FirewallMark: firewallMark,
+	}, nil
+}
+
+func (store *RedisStore) ArchivePeer(peer *RedisPeer) error {
+	data, err := json.Marshal(peer)
+	if err != nil {
+		return err
+	}
+
+	conn := store.conn()
+	defer conn.Close()
+
+	return transaction(conn, []redisCommand{
+		{"hset", []interface{}{fmt.Sprintf("%s:%s:%s", redisRoot, redisArchive, peer.Uuid),
+			"peer", data,
+			"archivedAt", time.Now().UTC().Format(time.RFC3339),
+		}},
+		{"sadd", []interface{}{fmt.Sprintf("%s:%s", redisRoot, redisArchive), peer.Uuid}},
+	})
+}
+
+func (store *RedisStore) RecordStaleAction(action *StaleAction) error {
+	data, err := json.Marshal(action)
+	if err != nil {
+		return err
+	}
+
+	conn := store.conn()
+	defer conn.Close()
+
+	key := fmt.Sprintf("%s:%s", redisRoot, redisStaleActions)
+
+	return transaction(conn, []redisCommand{
+		{"lpush", []interface{}{key, data}},
+		{"ltrim", []interface{}{key, 0, maxStaleActions - 1}},
+	})
+}
+
+func (store *RedisStore) GetStaleActions(limit int) ([]*StaleAction, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	entries, err := redis.ByteSlices(conn.Do("lrange", fmt.Sprintf("%s:%s", redisRoot, redisStaleActions), 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	actions := make([]*StaleAction, 0, len(entries))
+	for _, entry := range entries {
+		action := &StaleAction{}
+		if json.Unmarshal(entry, action) == nil {
+			actions = append(actions, action)
+		}
+	}
+
+	return actions, nil
+}
+
+// Traffic is kept in one hash per peer, with <unix hour>:rx and <unix hour>:tx fields
+
+func (store *RedisStore) AddTraffic(uuid string, hour time.Time, receive, transmit int64) error {
+	conn := store.conn()
+	defer conn.Close()
+
+	key := fmt.Sprintf("%s:%s:%s", redisRoot, redisTraffic, uuid)
+
+	return transaction(conn, []redisCommand{
+		{"hincrby", []interface{}{key, fmt.Sprintf("%d:rx", hour.Unix()), receive}},
+		{"hincrby", []interface{}{key, fmt.Sprintf("%d:tx", hour.Unix()), transmit}},
+	})
+}
+
+func (store *RedisStore) GetTraffic(uuid string, since time.Time) (receive, transmit int64, err error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("hgetall", fmt.Sprintf("%s:%s:%s", redisRoot, redisTraffic, uuid)))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for field, value := range values {
+		hour, direction, ok := parseTrafficField(field)
+		if !ok || hour.Before(since) {
+			continue
+		}
+
+		bytes, _ := strconv.ParseInt(value, 10, 64)
+		if direction == "rx" {
+			receive += bytes
+		} else {
+			transmit += bytes
+		}
+	}
+
+	return
+}
+
+func (store *RedisStore) PruneTraffic(uuid string, before time.Time) error {
+	conn := store.conn()
+	defer conn.Close()
+
+	key := fmt.Sprintf("%s:%s:%s", redisRoot, redisTraffic, uuid)
+
+	fields, err := redis.Strings(conn.Do("hkeys", key))
+	if err != nil {
+		return err
+	}
+
+	old := []interface{}{key}
+	for _, field := range fields {
+		if hour, _, ok := parseTrafficField(field); !ok || hour.Before(before) {
+			old = append(old, field)
+		}
+	}
+
+	if len(old) == 1 {
+		return nil
+	}
+
+	_, err = conn.Do("hdel", old...)
+	return err
+}
+
+func parseTrafficField(field string) (hour time.Time, direction string, ok bool) {
+	unix, direction, found := strings.Cut(field, ":")
+	if !found {
+		return time.Time{}, "", false
+	}
+
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	return time.Unix(seconds, 0), direction, true
+}
+
+func (store *RedisStore) SetLastSeen(uuid string, lastSeen time.Time) error {
+	conn := store.conn()
+	defer conn.Close()
+
+	_, err := conn.Do("set", fmt.Sprintf("%s:%s:%s:lastSeen", redisRoot, redisPeer, uuid), lastSeen.Format(time.RFC3339))
+	return err
+}
+
+func (store *RedisStore) GetLastSeen(uuid string) (time.Time, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	lastSeen, err := optionalString(conn, fmt.Sprintf("%s:%s:%s:lastSeen", redisRoot, redisPeer, uuid))
+	if err != nil || lastSeen == "" {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339, lastSeen)
+}
+
+func (store *RedisStore) AddHistory(uuid string, entry *HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	conn := store.conn()
+	defer conn.Close()
+
+	key := fmt.Sprintf("%s:%s:%s", redisRoot, redisHistory, uuid)
+
+	return transaction(conn, []redisCommand{
+		{"lpush", []interface{}{key, data}},
+		{"ltrim", []interface{}{key, 0, maxHistory - 1}},
+	})
+}
+
+func (store *RedisStore) GetHistory(uuid string, limit int) ([]*HistoryEntry, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	entries, err := redis.ByteSlices(conn.Do("lrange", fmt.Sprintf("%s:%s:%s", redisRoot, redisHistory, uuid), 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]*HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		historyEntry := &HistoryEntry{}
+		if json.Unmarshal(entry, historyEntry) == nil {
+			history = append(history, historyEntry)
+		}
+	}
+
+	return history, nil
+}
+
+func (store *RedisStore) SetSession(tokenHash string, session *Session) error {
+	ttl := int(time.Until(session.ExpiresAt).Seconds())
+	if ttl <= 0 {
+		return fmt.Errorf("session already expired")
+	}
+
+	conn := store.conn()
+	defer conn.Close()
+
+	key := fmt.Sprintf("%s:%s:%s", redisRoot, redisSessions, tokenHash)
+
+	return transaction(conn, []redisCommand{
+		{"hset", []interface{}{key,
+			"admin", strconv.FormatBool(session.Admin),
+			"username", session.Username,
+			"expiresAt", session.ExpiresAt.UTC().Format(time.RFC3339),
+		}},
+		{"expire", []interface{}{key, ttl}},
+	})
+}
+
+func (store *RedisStore) GetSession(tokenHash string) (*Session, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("hgetall", fmt.Sprintf("%s:%s:%s", redisRoot, redisSessions, tokenHash)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, values["expiresAt"])
+	if err != nil || time.Now().After(expiresAt) {
+		return nil, ErrSessionNotFound
+	}
+
+	return &Session{
+		Admin:     values["admin"] == "true",
+		Username:  values["username"],
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (store *RedisStore) DeleteSession(tokenHash string) error {
+	conn := store.conn()
+	defer conn.Close()
+
+	_, err := conn.Do("del", fmt.Sprintf("%s:%s:%s", redisRoot, redisSessions, tokenHash))
+	return err
+}
+
+func (store *RedisStore) SetApiKey(key *ApiKey) error {
+	groups, err := json.Marshal(key.Groups)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := ""
+	if !key.ExpiresAt.IsZero() {
+		expiresAt = key.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+
+	lastUsed := ""
+	if !key.LastUsed.IsZero() {
+		lastUsed = key.LastUsed.UTC().Format(time.RFC3339)
+	}
+
+	conn := store.conn()
+	defer conn.Close()
+
+	return transaction(conn, []redisCommand{
+		{"hset", []interface{}{fmt.Sprintf("%s:%s:%s", redisRoot, redisApiKeys, key.Id),
+			"name", key.Name,
+			"hash", key.Hash,
+			"groups", groups,
+			"createdAt", key.CreatedAt.UTC().Format(time.RFC3339),
+			"expiresAt", expiresAt,
+			"lastUsed", lastUsed,
+		}},
+		{"sadd", []interface{}{fmt.Sprintf("%s:%s", redisRoot, redisApiKeys), key.Id}},
+		{"set", []interface{}{fmt.Sprintf("%s:%s:%s", redisRoot, apiKeySearchHash, key.Hash), key.Id}},
+	})
+}
+
+func (store *RedisStore) GetApiKey(id string) (*ApiKey, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	return getApiKey(conn, id)
+}
+
+func getApiKey(conn redis.Conn, id string) (*ApiKey, error) {
+	values, err := redis.StringMap(conn.Do("hgetall", fmt.Sprintf("%s:%s:%s", redisRoot, redisApiKeys, id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrApiKeyNotFound
+	}
+
+	key := &ApiKey{
+		Id:     id,
+		Name:   values["name"],
+		Hash:   values["hash"],
+		Groups: map[string][]string{},
+	}
+
+	_ = json.Unmarshal([]byte(values["groups"]), &key.Groups)
+	key.CreatedAt, _ = time.Parse(time.RFC3339, values["createdAt"])
+	key.ExpiresAt, _ = time.Parse(time.RFC3339, values["expiresAt"])
+	key.LastUsed, _ = time.Parse(time.RFC3339, values["lastUsed"])
+
+	return key, nil
+}
+
+func (store *RedisStore) GetApiKeyByHash(keyHash string) (*ApiKey, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	id, err := redis.String(conn.Do("get", fmt.Sprintf("%s:%s:%s", redisRoot, apiKeySearchHash, keyHash)))
+	if err == redis.ErrNil {
+		return nil, ErrApiKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return getApiKey(conn, id)
+}
+
+func (store *RedisStore) GetApiKeys() ([]*ApiKey, error) {
+	conn := store.conn()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("smembers", fmt.Sprintf("%s:%s", redisRoot, redisApiKeys)))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*ApiKey, 0, len(ids))
+	for _, id := range ids {
+		key, err := getApiKey(conn, id)
+		if err == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (store *RedisStore) TouchApiKey(id string, lastUsed time.Time) error {
+	conn := store.conn()
+	defer conn.Close()
+
+	_, err := conn.Do("hset", fmt.Sprintf("%s:%s:%s", redisRoot, redisApiKeys, id), "lastUsed", lastUsed.UTC().Format(time.RFC3339))
+	return err
+}
+
+func (store *RedisStore) DeleteApiKey(id string) error {
+	conn := store.conn()
+	defer conn.Close()
+
+	key, err := getApiKey(conn, id)
+	if err != nil {
+		return err
+	}
+
+	return transaction(conn, []redisCommand{
+		{"srem", []interface{}{fmt.Sprintf("%s:%s", redisRoot, redisApiKeys), id}},
+		{"del", []interface{}{
+			fmt.Sprintf("%s:%s:%s", redisRoot, redisApiKeys, id),
+			fmt.Sprintf("%s:%s:%s", redisRoot, apiKeySearchHash, key.Hash),
+		}},
+	})
+}
+
+// Audit entries are kept in a sorted set scored by their time in unix milliseconds
+
+func (store *RedisStore) AddAudit(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	conn := store.conn()
+	defer conn.Close()
+
+	_, err = conn.Do("zadd", fmt.Sprintf("%s:%s", redisRoot, redisAudit), entry.Time.UnixMilli(), data)
+	return err
+}
+
+func (store *RedisStore) QueryAudit(filter AuditFilter) ([]*AuditEntry, error) {
+	max := "+inf"
+	if !filter.Until.IsZero() {
+		max = strconv.FormatInt(filter.Until.UnixMilli(), 10)
+	}
+
+	min := "-inf"
+	if !filter.Since.IsZero() {
+		min = strconv.FormatInt(filter.Since.UnixMilli(), 10)
+	}
+
+	conn := store.conn()
+	defer conn.Close()
+
+	entries := []*AuditEntry{}
+
+	for offset := 0; ; offset += auditPage {
+		page, err := redis.ByteSlices(conn.Do("zrevrangebyscore", fmt.Sprintf("%s:%s", redisRoot, redisAudit), max, min, "limit", offset, auditPage))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, data := range page {
+			entry := &AuditEntry{}
+			if json.Unmarshal(data, entry) != nil || !filter.Matches(entry) {
+				continue
+			}
+
+			entries = append(entries, entry)
+			if filter.Limit > 0 && len(entries) >= filter.Limit {
+				return entries, nil
+			}
+		}
+
+		if len(page) < auditPage {
+			return entries, nil
+		}
+	}
+}
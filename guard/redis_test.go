@@ -0,0 +1,74 @@
+package guard
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeConn records what is sent to it and answers EXEC with reply
+type fakeConn struct {
+	sent    []string
+	reply   interface{}
+	sendErr error
+}
+
+func (conn *fakeConn) Close() error { return nil }
+func (conn *fakeConn) Err() error   { return nil }
+func (conn *fakeConn) Flush() error { return nil }
+
+func (conn *fakeConn) Receive() (interface{}, error) { return nil, nil }
+
+func (conn *fakeConn) Send(name string, args ...interface{}) error {
+	if conn.sendErr != nil && name != "multi" {
+		return conn.sendErr
+	}
+	conn.sent = append(conn.sent, name)
+	return nil
+}
+
+func (conn *fakeConn) Do(name string, args ...interface{}) (interface{}, error) {
+	conn.sent = append(conn.sent, name)
+	if name == "exec" {
+		return conn.reply, nil
+	}
+	return "OK", nil
+}
+
+func TestTransaction(t *testing.T) {
+	commands := []redisCommand{
+		{"sadd", []interface{}{"bakaguard:peers", "a"}},
+		{"set", []interface{}{"bakaguard:peers:a:group", "test"}},
+	}
+
+	tests := []struct {
+		name    string
+		conn    *fakeConn
+		wantErr bool
+		want    []string
+	}{
+		{"applied", &fakeConn{reply: []interface{}{int64(1), "OK"}}, false, []string{"multi", "sadd", "set", "exec"}},
+		{"watched key changed", &fakeConn{reply: nil}, true, []string{"multi", "sadd", "set", "exec"}},
+		{"command failed", &fakeConn{reply: []interface{}{int64(1), redis.Error("WRONGTYPE")}}, true, []string{"multi", "sadd", "set", "exec"}},
+		{"send failed", &fakeConn{sendErr: errors.New("broken pipe")}, true, []string{"multi", "discard"}},
+	}
+
+	for _, test := range tests {
+		err := transaction(test.conn, commands)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: err = %v, want error %t", test.name, err, test.wantErr)
+		}
+
+		if len(test.conn.sent) != len(test.want) {
+			t.Errorf("%s: sent %v, want %v", test.name, test.conn.sent, test.want)
+			continue
+		}
+		for i := range test.want {
+			if test.conn.sent[i] != test.want[i] {
+				t.Errorf("%s: sent %v, want %v", test.name, test.conn.sent, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package guard
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+var ErrSecretKey = fmt.Errorf("secretKey must be 32 base64 encoded bytes to store secrets, generate one with: head -c 32 /dev/urandom | base64")
+
+// CheckSecretKey makes sure the configured secretKey can seal secrets, interface and preshared keys can't be stored without it
+func (guard *Guard) CheckSecretKey() error {
+	_, err := guard.secretCipher()
+	return err
+}
+
+func (guard *Guard) secretCipher() (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(guard.config.SecretKey)
+	if err != nil || len(key) != 32 {
+		return nil, ErrSecretKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret seals a secret with the configured secretKey so it can be stored, empty stays empty
+func (guard *Guard) encryptSecret(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+
+	gcm, err := guard.secretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func (guard *Guard) decryptSecret(sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+
+	gcm, err := guard.secretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("unable to read stored secret")
+	}
+
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to open stored secret, secretKey was changed since it was sealed")
+	}
+
+	return string(secret), nil
+}
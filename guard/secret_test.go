@@ -0,0 +1,98 @@
+package guard
+
+import "testing"
+
+func TestSecretSealing(t *testing.T) {
+	guard, _, _ := createTestGuard(t)
+
+	sealed, err := guard.encryptSecret("preshared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed == "preshared" {
+		t.Fatal("secret stored as plain text")
+	}
+
+	opened, err := guard.decryptSecret(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != "preshared" {
+		t.Errorf("opened %q, want %q", opened, "preshared")
+	}
+
+	// Empty means no secret, it isn't sealed
+	if sealed, _ := guard.encryptSecret(""); sealed != "" {
+		t.Errorf("empty secret sealed to %q", sealed)
+	}
+
+	// A different key can't open it
+	guard.config.SecretKey = "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="
+	if _, err := guard.decryptSecret(sealed); err == nil {
+		t.Errorf("opened a secret with the wrong key")
+	}
+}
+
+func TestCheckSecretKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"valid", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", false},
+		{"missing", "", true},
+		{"too short", "AAAAAAAAAAAAAAAAAAAAAA==", true},
+		{"not base64", "not a key", true},
+	}
+
+	for _, test := range tests {
+		guard, _, _ := createTestGuard(t)
+		guard.config.SecretKey = test.key
+
+		err := guard.CheckSecretKey()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: err = %v, want error %t", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestRotatePresharedKey(t *testing.T) {
+	guard, wg, store := createTestGuard(t)
+
+	presharedKey, err := GeneratePresharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := CreatePeer(generatePublicKey(t), "test", "", "", 0, nil, map[string]string{})
+	peer.PresharedKey = presharedKey
+	if err := guard.SetPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := guard.RotatePresharedKey(peer.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.PresharedKey == "" || rotated.PresharedKey == presharedKey {
+		t.Errorf("preshared key not rotated")
+	}
+
+	device, _ := wg.Device("wg0")
+	if device.Peers[0].PresharedKey.String() != rotated.PresharedKey {
+		t.Errorf("device still has the old preshared key")
+	}
+
+	stored, _ := store.GetPeer(peer.Uuid)
+	if stored.PresharedKey == rotated.PresharedKey {
+		t.Errorf("preshared key stored unsealed")
+	}
+
+	got, err := guard.GetWgPeer(peer.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PresharedKey != rotated.PresharedKey {
+		t.Errorf("stored preshared key isn't the rotated one")
+	}
+}
@@ -0,0 +1,55 @@
+package guard
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// defaultSessionLifetime is used when sessionLifetime isn't configured
+const defaultSessionLifetime = 24 * time.Hour
+
+// hashToken is what a token is stored under, so the store alone can't be used to log in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession stores a new session and returns its token, the token itself is never stored
+func (guard *Guard) CreateSession(admin bool, username string) (string, *Session, error) {
+	lifetime, err := time.ParseDuration(guard.config.SessionLifetime)
+	if err != nil || lifetime <= 0 {
+		lifetime = defaultSessionLifetime
+	}
+
+	tokenBytes := make([]byte, 32)
+	_, err = rand.Read(tokenBytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to generate session token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	session := &Session{
+		Admin:     admin,
+		Username:  username,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+
+	err = guard.store.SetSession(hashToken(token), session)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to store session: %w", err)
+	}
+
+	return token, session, nil
+}
+
+func (guard *Guard) GetSession(token string) (*Session, error) {
+	return guard.store.GetSession(hashToken(token))
+}
+
+func (guard *Guard) DeleteSession(token string) error {
+	return guard.store.DeleteSession(hashToken(token))
+}
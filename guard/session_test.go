@@ -0,0 +1,56 @@
+package guard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	guard, _, store := createTestGuard(t)
+	guard.config.SessionLifetime = "1h"
+
+	token, session, err := guard.CreateSession(false, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Username != "bob" || session.Admin {
+		t.Errorf("session = %+v, want bob's", session)
+	}
+	if lifetime := time.Until(session.ExpiresAt); lifetime > time.Hour || lifetime < 59*time.Minute {
+		t.Errorf("session lasts %s, want the configured 1h", lifetime)
+	}
+
+	// Only the hash is stored, so the store can't be used to log in
+	if _, ok := store.sessions[token]; ok {
+		t.Errorf("token stored as is")
+	}
+
+	restored, err := guard.GetSession(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Username != "bob" {
+		t.Errorf("restored session = %+v, want bob's", restored)
+	}
+
+	if _, err := guard.GetSession(token + "x"); err != ErrSessionNotFound {
+		t.Errorf("wrong token: err = %v, want ErrSessionNotFound", err)
+	}
+
+	if err := guard.DeleteSession(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := guard.GetSession(token); err != ErrSessionNotFound {
+		t.Errorf("after logout: err = %v, want ErrSessionNotFound", err)
+	}
+
+	// Without a usable sessionLifetime the default applies
+	guard.config.SessionLifetime = "forever"
+	_, session, err = guard.CreateSession(true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := time.Until(session.ExpiresAt); lifetime > defaultSessionLifetime || lifetime < defaultSessionLifetime-time.Minute {
+		t.Errorf("session lasts %s, want %s", lifetime, defaultSessionLifetime)
+	}
+}
@@ -0,0 +1,152 @@
+package guard
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxStaleActions is how many stale actions are kept before the oldest are dropped
+const maxStaleActions = 1000
+
+const (
+	StaleActionDisable = "disable"
+	StaleActionDelete  = "delete"
+)
+
+// isStale reports whether the peer has gone longer than threshold since lastActivity
+func isStale(lastActivity time.Time, threshold time.Duration, now time.Time) bool {
+	return now.Sub(lastActivity) > threshold
+}
+
+// lastSeen is the peer's latest handshake, from the device or else as last recorded in the store.
+// The device forgets handshakes on reboot or when the interface is recreated, the store doesn't.
+func (guard *Guard) lastSeen(peer *Peer) (time.Time, error) {
+	lastSeen, err := guard.store.GetLastSeen(peer.Uuid)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The watcher normally records handshakes, this covers it not running
+	if peer.LastHandshake.After(lastSeen) {
+		err = guard.store.SetLastSeen(peer.Uuid, peer.LastHandshake)
+		if err != nil {
+			fmt.Printf("Unable to record last seen for %s: %s\n", peer.Uuid, err)
+		}
+		return peer.LastHandshake, nil
+	}
+	return lastSeen, nil
+}
+
+// GetStalePeers returns the enabled peers of the group that haven't handshaken within its staleAfter
+func (guard *Guard) GetStalePeers(group string) (map[string]*Peer, error) {
+	stale := map[string]*Peer{}
+
+	threshold := guard.config.Websocket.Groups[group].StaleThreshold()
+	if threshold == 0 {
+		return stale, nil
+	}
+
+	peers, err := guard.GetGroupPeers(group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for peerUuid, peer := range peers {
+		if peer.Disabled {
+			continue
+		}
+
+		peer.LastHandshake, err = guard.lastSeen(peer)
+		if err != nil {
+			return nil, err
+		}
+
+		// A peer never seen is measured from its creation, or from startup if it may have been seen before
+		lastActivity := peer.LastHandshake
+		if lastActivity.IsZero() {
+			lastActivity = peer.CreatedAt
+			if guard.startedAt.After(lastActivity) {
+				lastActivity = guard.startedAt
+			}
+		}
+
+		if isStale(lastActivity, threshold, now) {
+			stale[peerUuid] = peer
+		}
+	}
+
+	return stale, nil
+}
+
+func (guard *Guard) GetStaleActions(limit int) ([]*StaleAction, error) {
+	return guard.store.GetStaleActions(limit)
+}
+
+// StartStaleReaper applies each group's stalePolicy every interval until the process exits
+func (guard *Guard) StartStaleReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			guard.ReapStalePeers()
+		}
+	}()
+}
+
+// ReapStalePeers disables or deletes the stale peers of every group with a stalePolicy, recording each action taken
+func (guard *Guard) ReapStalePeers() []*StaleAction {
+	actions := []*StaleAction{}
+
+	for group, settings := range guard.config.Websocket.Groups {
+		if settings.StalePolicy != StaleActionDisable && settings.StalePolicy != StaleActionDelete {
+			continue
+		}
+
+		peers, err := guard.GetStalePeers(group)
+		if err != nil {
+			fmt.Printf("Unable to find stale peers in %s: %s\n", group, err)
+			continue
+		}
+
+		for _, peer := range peers {
+			actions = append(actions, guard.reapPeer(peer, settings.StalePolicy))
+		}
+	}
+
+	return actions
+}
+
+func (guard *Guard) reapPeer(peer *Peer, policy string) *StaleAction {
+	action := &StaleAction{
+		Time:          time.Now(),
+		Uuid:          peer.Uuid,
+		Group:         peer.Group,
+		Name:          peer.Name,
+		Action:        policy,
+		LastHandshake: peer.LastHandshake,
+	}
+
+	var err error
+	switch policy {
+	case StaleActionDisable:
+		_, err = guard.DisablePeer(peer.Uuid)
+	case StaleActionDelete:
+		err = guard.DeletePeer(peer.Uuid)
+	}
+
+	if err != nil {
+		action.Error = err.Error()
+		fmt.Printf("Unable to %s stale peer %s: %s\n", policy, peer.Uuid, err)
+	} else {
+		fmt.Printf("Stale peer %s (%s) %sd, last seen %s\n", peer.Uuid, peer.Name, policy, peer.LastHandshake.Format(time.RFC3339))
+	}
+
+	err = guard.store.RecordStaleAction(action)
+	if err != nil {
+		fmt.Printf("Unable to record stale action for %s: %s\n", peer.Uuid, err)
+	}
+
+	return action
+}
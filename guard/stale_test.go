@@ -0,0 +1,123 @@
+package guard
+
+import (
+	"testing"
+	"time"
+)
+
+// addStalePeers adds a peer created two hours ago for each case, returning them by name
+func addStalePeers(t *testing.T, guard *Guard, names ...string) map[string]*Peer {
+	t.Helper()
+
+	peers := map[string]*Peer{}
+	for _, name := range names {
+		peer := CreatePeer(generatePublicKey(t), "test", name, "", 0, nil, map[string]string{})
+		peer.CreatedAt = time.Now().Add(-2 * time.Hour)
+		if err := guard.SetPeer(peer); err != nil {
+			t.Fatal(err)
+		}
+		peers[name] = peer
+	}
+	return peers
+}
+
+func setStaleSettings(guard *Guard, staleAfter, policy string) {
+	group := guard.config.Websocket.Groups["test"]
+	group.StaleAfter = staleAfter
+	group.StalePolicy = policy
+	guard.config.Websocket.Groups["test"] = group
+}
+
+func TestGetStalePeers(t *testing.T) {
+	guard, wg, store := createTestGuard(t)
+	setStaleSettings(guard, "1h", "")
+	guard.startedAt = time.Now().Add(-3 * time.Hour)
+
+	peers := addStalePeers(t, guard, "never seen", "seen recently", "seen by the device", "seen long ago", "disabled")
+
+	_ = store.SetLastSeen(peers["seen recently"].Uuid, time.Now().Add(-10*time.Minute))
+	_ = store.SetLastSeen(peers["seen long ago"].Uuid, time.Now().Add(-90*time.Minute))
+	_ = store.SetLastSeen(peers["seen by the device"].Uuid, time.Now().Add(-90*time.Minute))
+	for i, devicePeer := range wg.devices["wg0"].Peers {
+		if devicePeer.PublicKey.String() == peers["seen by the device"].PublicKey {
+			wg.devices["wg0"].Peers[i].LastHandshakeTime = time.Now().Add(-5 * time.Minute)
+		}
+	}
+	if _, err := guard.DisablePeer(peers["disabled"].Uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := guard.GetStalePeers("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, peer := range peers {
+		_, got := stale[peer.Uuid]
+		want := name == "never seen" || name == "seen long ago"
+		if got != want {
+			t.Errorf("%s: stale = %t, want %t", name, got, want)
+		}
+	}
+
+	// The device's newer handshake is kept for when the device forgets it
+	lastSeen, _ := store.GetLastSeen(peers["seen by the device"].Uuid)
+	if time.Since(lastSeen) > 10*time.Minute {
+		t.Errorf("device handshake not recorded, last seen %s", lastSeen)
+	}
+
+	// After a restart, peers never seen get the full threshold again
+	guard.startedAt = time.Now()
+	stale, _ = guard.GetStalePeers("test")
+	if _, ok := stale[peers["never seen"].Uuid]; ok {
+		t.Errorf("peer never seen is stale right after startup")
+	}
+
+	setStaleSettings(guard, "", "")
+	if stale, _ := guard.GetStalePeers("test"); len(stale) != 0 {
+		t.Errorf("%d stale peers without staleAfter, want none", len(stale))
+	}
+}
+
+func TestReapStalePeers(t *testing.T) {
+	for _, policy := range []string{"", StaleActionDisable, StaleActionDelete} {
+		guard, _, store := createTestGuard(t)
+		setStaleSettings(guard, "1h", policy)
+		guard.startedAt = time.Now().Add(-3 * time.Hour)
+
+		peers := addStalePeers(t, guard, "stale", "fresh")
+		_ = store.SetLastSeen(peers["fresh"].Uuid, time.Now())
+
+		actions := guard.ReapStalePeers()
+		if policy == "" {
+			if len(actions) != 0 {
+				t.Errorf("actions %v without a stalePolicy", actions)
+			}
+			continue
+		}
+
+		if len(actions) != 1 || actions[0].Uuid != peers["stale"].Uuid || actions[0].Action != policy || actions[0].Error != "" {
+			t.Fatalf("%s: actions = %+v, want the stale peer %sd", policy, actions, policy)
+		}
+
+		stored, err := guard.GetWgPeer(peers["stale"].Uuid)
+		switch policy {
+		case StaleActionDisable:
+			if err != nil || !stored.Disabled {
+				t.Errorf("disable: stale peer = %+v, %v, want it kept and disabled", stored, err)
+			}
+		case StaleActionDelete:
+			if err != ErrPeerNotFound {
+				t.Errorf("delete: stale peer still stored, err = %v", err)
+			}
+		}
+
+		if fresh, err := guard.GetWgPeer(peers["fresh"].Uuid); err != nil || fresh.Disabled {
+			t.Errorf("%s: fresh peer reaped", policy)
+		}
+
+		recorded, _ := guard.GetStaleActions(10)
+		if len(recorded) != 1 {
+			t.Errorf("%s: %d actions recorded, want 1", policy, len(recorded))
+		}
+	}
+}
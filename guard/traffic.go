@@ -0,0 +1,220 @@
+package guard
+
+import (
+	"fmt"
+	"time"
+)
+
+// trafficRetention is how long hourly transfer totals are kept
+const trafficRetention = 31 * 24 * time.Hour
+
+type trafficSample struct {
+	Time     time.Time
+	Receive  int64
+	Transmit int64
+}
+
+// peerTraffic is what the sampler remembers of a peer between samples
+type peerTraffic struct {
+	// counters are the device's totals at the last sample, used to work out what moved since
+	counters trafficSample
+	// recent holds what moved in each sample over the last hour
+	recent []trafficSample
+	// receiveRate and transmitRate are in bytes per second between the last two samples
+	receiveRate  float64
+	transmitRate float64
+}
+
+// StartTrafficSampler samples every peer's transfer counters every interval until the process exits
+func (guard *Guard) StartTrafficSampler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastPrune := time.Now().Truncate(time.Hour)
+
+		for range ticker.C {
+			err := guard.SampleTraffic()
+			if err != nil {
+				fmt.Println("Unable to sample traffic:", err)
+			}
+
+			if hour := time.Now().Truncate(time.Hour); hour.After(lastPrune) {
+				guard.pruneTraffic()
+				lastPrune = hour
+			}
+		}
+	}()
+}
+
+// SampleTraffic records what every peer on every interface transferred since the last sample
+func (guard *Guard) SampleTraffic() error {
+	peerMap, err := guard.store.GetPeerMap()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	hour := now.Truncate(time.Hour)
+	seen := make(map[string]struct{}, len(peerMap))
+
+	for _, iface := range guard.config.Interfaces {
+		device, err := guard.device(iface.Name)
+		if err != nil {
+			fmt.Printf("Unable to sample traffic on %s: %s\n", iface.Name, err)
+			continue
+		}
+
+		for _, devicePeer := range device.Peers {
+			uuid, ok := peerMap[devicePeer.PublicKey.String()]
+			if !ok {
+				continue
+			}
+			seen[uuid] = struct{}{}
+
+			delta, ok := guard.addSample(uuid, trafficSample{
+				Time:     now,
+				Receive:  devicePeer.ReceiveBytes,
+				Transmit: devicePeer.TransmitBytes,
+			})
+			if !ok || (delta.Receive == 0 && delta.Transmit == 0) {
+				continue
+			}
+
+			err = guard.store.AddTraffic(uuid, hour, delta.Receive, delta.Transmit)
+			if err != nil {
+				fmt.Printf("Unable to store traffic for %s: %s\n", uuid, err)
+			}
+		}
+	}
+
+	// Forget peers that are gone so they start over if they come back
+	guard.trafficLock.Lock()
+	for uuid := range guard.traffic {
+		if _, ok := seen[uuid]; !ok {
+			delete(guard.traffic, uuid)
+		}
+	}
+	guard.trafficLock.Unlock()
+
+	return nil
+}
+
+// addSample works out what moved since the peer's last sample, ok is false if there was nothing to compare to
+func (guard *Guard) addSample(uuid string, counters trafficSample) (delta trafficSample, ok bool) {
+	guard.trafficLock.Lock()
+	defer guard.trafficLock.Unlock()
+
+	traffic, ok := guard.traffic[uuid]
+	if !ok {
+		guard.traffic[uuid] = &peerTraffic{counters: counters}
+		return trafficSample{}, false
+	}
+
+	delta = trafficSample{
+		Time:     counters.Time,
+		Receive:  counters.Receive - traffic.counters.Receive,
+		Transmit: counters.Transmit - traffic.counters.Transmit,
+	}
+
+	// Counters start over when the peer is re-added or the interface is recreated
+	if delta.Receive < 0 || delta.Transmit < 0 {
+		delta.Receive = counters.Receive
+		delta.Transmit = counters.Transmit
+	}
+
+	hourAgo := counters.Time.Add(-time.Hour)
+	recent := traffic.recent[:0]
+	for _, sample := range traffic.recent {
+		if sample.Time.After(hourAgo) {
+			recent = append(recent, sample)
+		}
+	}
+
+	traffic.recent = append(recent, delta)
+
+	if elapsed := counters.Time.Sub(traffic.counters.Time).Seconds(); elapsed > 0 {
+		traffic.receiveRate = float64(delta.Receive) / elapsed
+		traffic.transmitRate = float64(delta.Transmit) / elapsed
+	}
+	traffic.counters = counters
+
+	return delta, true
+}
+
+func (guard *Guard) pruneTraffic() {
+	peerMap, err := guard.store.GetPeerMap()
+	if err != nil {
+		fmt.Println("Unable to prune traffic:", err)
+		return
+	}
+
+	before := time.Now().Add(-trafficRetention)
+	for _, uuid := range peerMap {
+		err = guard.store.PruneTraffic(uuid, before)
+		if err != nil {
+			fmt.Printf("Unable to prune traffic for %s: %s\n", uuid, err)
+		}
+	}
+}
+
+// GetPeerTraffic returns the peer's current throughput and its totals over the last hour, day and month
+func (guard *Guard) GetPeerTraffic(uuid string) (*TrafficStats, error) {
+	stats := &TrafficStats{}
+	now := time.Now()
+
+	guard.trafficLock.Lock()
+	if traffic, ok := guard.traffic[uuid]; ok {
+		for _, sample := range traffic.recent {
+			stats.LastHour.Receive += sample.Receive
+			stats.LastHour.Transmit += sample.Transmit
+		}
+
+		stats.ReceiveRate = traffic.receiveRate
+		stats.TransmitRate = traffic.transmitRate
+	}
+	guard.trafficLock.Unlock()
+
+	// Hourly totals are bucketed by the hour they started in, so the current hour counts towards both
+	var err error
+	stats.LastDay.Receive, stats.LastDay.Transmit, err = guard.store.GetTraffic(uuid, now.Add(-24*time.Hour).Truncate(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	stats.LastMonth.Receive, stats.LastMonth.Transmit, err = guard.store.GetTraffic(uuid, now.Add(-30*24*time.Hour).Truncate(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// GetGroupTraffic adds up the traffic of every peer in the group
+func (guard *Guard) GetGroupTraffic(group string) (*TrafficStats, error) {
+	uuids, err := guard.store.GetGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	total := &TrafficStats{}
+	for _, uuid := range uuids {
+		stats, err := guard.GetPeerTraffic(uuid)
+		if err != nil {
+			return nil, err
+		}
+
+		total.ReceiveRate += stats.ReceiveRate
+		total.TransmitRate += stats.TransmitRate
+		total.LastHour.add(stats.LastHour)
+		total.LastDay.add(stats.LastDay)
+		total.LastMonth.add(stats.LastMonth)
+	}
+
+	return total, nil
+}
+
+func (total *TrafficTotal) add(other TrafficTotal) {
+	total.Receive += other.Receive
+	total.Transmit += other.Transmit
+}
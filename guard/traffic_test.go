@@ -0,0 +1,82 @@
+package guard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddSample(t *testing.T) {
+	guard, _, _ := createTestGuard(t)
+	start := time.Now()
+
+	tests := []struct {
+		name              string
+		receive, transmit int64
+		wantOk            bool
+		wantRx, wantTx    int64
+		wantRxRate        float64
+	}{
+		{"first sample", 100, 50, false, 0, 0, 0},
+		{"moved", 300, 80, true, 200, 30, 20},
+		{"idle", 300, 80, true, 0, 0, 0},
+		{"counters reset", 40, 10, true, 40, 10, 4},
+	}
+
+	for i, test := range tests {
+		delta, ok := guard.addSample("a", trafficSample{
+			Time:     start.Add(time.Duration(i*10) * time.Second),
+			Receive:  test.receive,
+			Transmit: test.transmit,
+		})
+		if ok != test.wantOk {
+			t.Errorf("%s: ok = %t, want %t", test.name, ok, test.wantOk)
+		}
+		if delta.Receive != test.wantRx || delta.Transmit != test.wantTx {
+			t.Errorf("%s: delta = %d/%d, want %d/%d", test.name, delta.Receive, delta.Transmit, test.wantRx, test.wantTx)
+		}
+		if ok && guard.traffic["a"].receiveRate != test.wantRxRate {
+			t.Errorf("%s: receive rate = %f, want %f", test.name, guard.traffic["a"].receiveRate, test.wantRxRate)
+		}
+	}
+}
+
+func TestGetPeerTraffic(t *testing.T) {
+	guard, wg, _ := createTestGuard(t)
+
+	peer := CreatePeer(generatePublicKey(t), "test", "", "", 0, nil, map[string]string{})
+	if err := guard.SetPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	counters := [][2]int64{{1000, 500}, {1500, 700}, {2500, 900}}
+	for _, counter := range counters {
+		wg.devices["wg0"].Peers[0].ReceiveBytes = counter[0]
+		wg.devices["wg0"].Peers[0].TransmitBytes = counter[1]
+		if err := guard.SampleTraffic(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := guard.GetPeerTraffic(peer.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first sample only sets where counting starts from
+	want := TrafficTotal{Receive: 1500, Transmit: 400}
+	for name, total := range map[string]TrafficTotal{"hour": stats.LastHour, "day": stats.LastDay, "month": stats.LastMonth} {
+		if total != want {
+			t.Errorf("last %s = %+v, want %+v", name, total, want)
+		}
+	}
+
+	// A peer gone from the device is forgotten, its stored totals stay
+	wg.devices["wg0"].Peers = nil
+	if err := guard.SampleTraffic(); err != nil {
+		t.Fatal(err)
+	}
+	stats, _ = guard.GetPeerTraffic(peer.Uuid)
+	if stats.LastHour != (TrafficTotal{}) || stats.LastDay != want {
+		t.Errorf("after removal stats = %+v, want only stored totals", stats)
+	}
+}
@@ -1,42 +1,233 @@
 package guard
 
 import (
+	"encoding/json"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
-	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
 	"github.com/bob620/bakaguard/config"
 )
 
 type Guard struct {
-	config     config.Config
-	wg         *wgctrl.Client
-	redisConn  redis.Conn
-	redisRead  sync.Mutex
-	redisWrite sync.Mutex
+	config        config.Config
+	wg            WireguardClient
+	store         PeerStore
+	reconcileLock sync.RWMutex
+	lastReconcile atomic.Pointer[ReconcileResult]
+	traffic       map[string]*peerTraffic
+	trafficLock   sync.Mutex
+	watched       map[string]watchedPeer
+	watchLock     sync.Mutex
+	authLimiter   *AuthLimiter
+	listeners     map[int]func(PeerEvent)
+	nextListener  int
+	listenerLock  sync.RWMutex
+	startedAt     time.Time
+}
+
+// WireguardClient is the part of wgctrl.Client bakaguard uses to read and change devices
+type WireguardClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+// PeerStore persists the bakaguard side of a peer (uuid, group, name, description
+// and storage fields) along with the lookups needed to match it against the device.
+type PeerStore interface {
+	SetPeer(peer *RedisPeer) error
+	GetPeer(uuid string) (*RedisPeer, error)
+	DeletePeer(uuid, publicKey string) error
+	// GetPeerMap returns every known peer as publicKey -> uuid
+	GetPeerMap() (map[string]string, error)
+	// GetGroup returns the uuids of every peer in the group
+	GetGroup(group string) ([]string, error)
+
+	// GetAddresses returns every address handed out in the group as ip -> uuid
+	GetAddresses(group string) (map[string]string, error)
+	// ClaimAddress assigns ip to uuid unless it is already taken, reporting whether it was claimed
+	ClaimAddress(group, ip, uuid string) (bool, error)
+	// ReleaseAddresses frees every address in the group held by uuid
+	ReleaseAddresses(group, uuid string) error
+
+	SetInterface(iface *RedisInterface) error
+	GetInterface(name string) (*RedisInterface, error)
+
+	// ArchivePeer keeps a copy of the peer's record after it is deleted
+	ArchivePeer(peer *RedisPeer) error
+
+	// RecordStaleAction adds to the log of peers disabled or deleted for being stale, keeping only the most recent
+	RecordStaleAction(action *StaleAction) error
+	// GetStaleActions returns up to limit of the most recent stale actions, newest first
+	GetStaleActions(limit int) ([]*StaleAction, error)
+
+	// AddTraffic adds to the peer's transfer totals for the hour starting at hour
+	AddTraffic(uuid string, hour time.Time, receive, transmit int64) error
+	// GetTraffic sums the peer's hourly transfer totals from since onwards
+	GetTraffic(uuid string, since time.Time) (receive, transmit int64, err error)
+	// PruneTraffic drops the peer's hourly transfer totals from before before
+	PruneTraffic(uuid string, before time.Time) error
+
+	// SetLastSeen records the peer's latest handshake so it outlives the device forgetting it
+	SetLastSeen(uuid string, lastSeen time.Time) error
+	// GetLastSeen returns the peer's latest recorded handshake, zero if none was ever seen
+	GetLastSeen(uuid string) (time.Time, error)
+
+	// AddHistory records a connection event for the peer, keeping only its most recent
+	AddHistory(uuid string, entry *HistoryEntry) error
+	// GetHistory returns up to limit of the peer's most recent connection events, newest first
+	GetHistory(uuid string, limit int) ([]*HistoryEntry, error)
+
+	// SetSession stores a session under the hash of its token until it expires
+	SetSession(tokenHash string, session *Session) error
+	// GetSession returns the unexpired session stored under tokenHash
+	GetSession(tokenHash string) (*Session, error)
+	DeleteSession(tokenHash string) error
+
+	SetApiKey(key *ApiKey) error
+	GetApiKey(id string) (*ApiKey, error)
+	// GetApiKeyByHash finds a key by the hash of its secret
+	GetApiKeyByHash(keyHash string) (*ApiKey, error)
+	GetApiKeys() ([]*ApiKey, error)
+	// TouchApiKey sets when the key was last used
+	TouchApiKey(id string, lastUsed time.Time) error
+	DeleteApiKey(id string) error
+
+	AddAudit(entry *AuditEntry) error
+	// QueryAudit returns the entries matching filter, newest first
+	QueryAudit(filter AuditFilter) ([]*AuditEntry, error)
+}
+
+type RedisInterface struct {
+	Name         string
+	PrivateKey   string // sealed with the configured secretKey
+	ListenPort   int
+	FirewallMark int
+}
+
+type Interface struct {
+	Name         string `json:"name"`
+	PublicKey    string `json:"publicKey"`
+	ListenPort   int    `json:"listenPort"`
+	FirewallMark int    `json:"firewallMark"`
+	Peers        int    `json:"peers"`
 }
 
 type RedisPeer struct {
-	Uuid        string
-	Group       string
-	Name        string
-	Description string
-	PublicKey   string
-	Storage     map[string]string
+	Uuid         string
+	Interface    string
+	Group        string
+	Name         string
+	Description  string
+	PublicKey    string
+	PresharedKey string // sealed with the configured secretKey
+	Endpoint     string
+	AllowedIPs   []net.IPNet
+	KeepAlive    time.Duration
+	CreatedAt    time.Time // zero for peers stored before it was recorded
+	ExpiresAt    time.Time // zero for peers that never expire
+	Disabled     bool      // kept in the store but not put on the device
+	Storage      map[string]string
 }
 
 type Peer struct {
 	Uuid          string `json:"uuid"`
+	Interface     string `json:"interface"`
 	Group         string `json:"group"`
 	Name          string `json:"name"`
 	Description   string `json:"description"`
 	PublicKey     string
+	PresharedKey  string            `json:"-"`
+	Endpoint      string            `json:"endpoint"`
 	AllowedIPs    []net.IPNet       `json:"allowedIPs"`
 	KeepAlive     time.Duration     `json:"keepAlive"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	ExpiresAt     time.Time         `json:"expiresAt"`
+	ExpiresIn     time.Duration     `json:"expiresIn"`
+	Disabled      bool              `json:"disabled"`
 	LastHandshake time.Time         `json:"lastSeen"`
 	LastEndpoint  string            `json:"lastExternalIp"`
+	ReceiveBytes  int64             `json:"receiveBytes"`
+	TransmitBytes int64             `json:"transmitBytes"`
 	Storage       map[string]string `json:"storage"`
 }
+
+type StaleAction struct {
+	Time          time.Time `json:"time"`
+	Uuid          string    `json:"uuid"`
+	Group         string    `json:"group"`
+	Name          string    `json:"name"`
+	Action        string    `json:"action"`
+	LastHandshake time.Time `json:"lastSeen"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type TrafficTotal struct {
+	Receive  int64 `json:"receive"`
+	Transmit int64 `json:"transmit"`
+}
+
+type TrafficStats struct {
+	// ReceiveRate and TransmitRate are in bytes per second over the last sample
+	ReceiveRate  float64      `json:"receiveRate"`
+	TransmitRate float64      `json:"transmitRate"`
+	LastHour     TrafficTotal `json:"lastHour"`
+	LastDay      TrafficTotal `json:"lastDay"`
+	LastMonth    TrafficTotal `json:"lastMonth"`
+}
+
+type HistoryEntry struct {
+	Time             time.Time `json:"time"`
+	Type             string    `json:"type"`
+	Endpoint         string    `json:"endpoint"`
+	PreviousEndpoint string    `json:"previousEndpoint,omitempty"`
+}
+
+type Session struct {
+	Admin     bool      `json:"admin"`
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type ApiKey struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Hash string `json:"-"`
+	// Groups maps a group to the scopes the key has in it, like a user's groups
+	Groups    map[string][]string `json:"groups"`
+	CreatedAt time.Time           `json:"createdAt"`
+	ExpiresAt time.Time           `json:"expiresAt"` // zero for keys that never expire
+	LastUsed  time.Time           `json:"lastUsed"`
+}
+
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Identity   string    `json:"identity"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	// Uuid is the peer changed, Target is whatever else was, like an interface or api key
+	Uuid   string          `json:"uuid,omitempty"`
+	Target string          `json:"target,omitempty"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// AuditFilter narrows an audit query, zero fields match everything
+type AuditFilter struct {
+	Since    time.Time
+	Until    time.Time
+	Identity string
+	Uuid     string
+	Limit    int
+}
+
+func (filter AuditFilter) Matches(entry *AuditEntry) bool {
+	return (filter.Since.IsZero() || !entry.Time.Before(filter.Since)) &&
+		(filter.Until.IsZero() || !entry.Time.After(filter.Until)) &&
+		(filter.Identity == "" || entry.Identity == filter.Identity) &&
+		(filter.Uuid == "" || entry.Uuid == filter.Uuid)
+}
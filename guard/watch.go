@@ -0,0 +1,174 @@
+package guard
+
+import (
+	"fmt"
+	"time"
+)
+
+// onlineTimeout is how long after its last handshake a peer still counts as online.
+// WireGuard rehandshakes every two minutes while traffic flows and gives up on a session after three.
+const onlineTimeout = 3 * time.Minute
+
+// maxHistory is how many connection events are kept per peer before the oldest are dropped
+const maxHistory = 500
+
+// watchedPeer is what the watcher saw of a peer on the device at the last snapshot
+type watchedPeer struct {
+	lastHandshake time.Time
+	endpoint      string
+	online        bool
+	// addedAt is when watchNewPeer remembered the peer, zero for peers seen on a device
+	addedAt time.Time
+}
+
+// StartPeerWatcher snapshots every device each interval, raising events for what changed on it
+func (guard *Guard) StartPeerWatcher(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := guard.WatchPeers()
+			if err != nil {
+				fmt.Println("Unable to watch peers:", err)
+			}
+		}
+	}()
+}
+
+// WatchPeers compares the devices against the last snapshot, recording when peers come online, go offline or move.
+// Peers seen for the first time are only remembered, unless they were added since the last snapshot.
+func (guard *Guard) WatchPeers() error {
+	peerMap, err := guard.store.GetPeerMap()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	snapshot := make(map[string]watchedPeer, len(peerMap))
+
+	for _, iface := range guard.config.Interfaces {
+		device, err := guard.device(iface.Name)
+		if err != nil {
+			continue
+		}
+
+		for _, devicePeer := range device.Peers {
+			uuid, ok := peerMap[devicePeer.PublicKey.String()]
+			if !ok {
+				continue
+			}
+
+			current := watchedPeer{
+				lastHandshake: devicePeer.LastHandshakeTime,
+				online:        !devicePeer.LastHandshakeTime.IsZero() && now.Sub(devicePeer.LastHandshakeTime) < onlineTimeout,
+			}
+			if devicePeer.Endpoint != nil {
+				current.endpoint = devicePeer.Endpoint.String()
+			}
+
+			snapshot[uuid] = current
+		}
+	}
+
+	// Merge rather than replace, a peer added while the devices were read isn't in the snapshot yet
+	guard.watchLock.Lock()
+	previous := make(map[string]watchedPeer, len(guard.watched))
+	for uuid, last := range guard.watched {
+		previous[uuid] = last
+
+		if _, ok := snapshot[uuid]; !ok && !last.addedAt.After(now) {
+			delete(guard.watched, uuid)
+		}
+	}
+	for uuid, current := range snapshot {
+		guard.watched[uuid] = current
+	}
+	guard.watchLock.Unlock()
+
+	for uuid, current := range snapshot {
+		last, ok := previous[uuid]
+
+		// The device forgets handshakes when the interface is recreated, the store keeps the last one for stale checks
+		if !current.lastHandshake.IsZero() && (!ok || current.lastHandshake.After(last.lastHandshake)) {
+			err = guard.store.SetLastSeen(uuid, current.lastHandshake)
+			if err != nil {
+				fmt.Printf("Unable to record last seen for %s: %s\n", uuid, err)
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		if last.lastHandshake.IsZero() && !current.lastHandshake.IsZero() {
+			guard.emitFor(EventPeerHandshake, uuid)
+		}
+
+		switch {
+		case current.online && !last.online:
+			guard.recordHistory(uuid, EventPeerOnline, &HistoryEntry{
+				Time:     current.lastHandshake,
+				Endpoint: current.endpoint,
+			})
+		case !current.online && last.online:
+			// The session ran out onlineTimeout after the last handshake, unless the peer was re-added and lost it
+			offlineAt := now
+			if !current.lastHandshake.IsZero() {
+				offlineAt = current.lastHandshake.Add(onlineTimeout)
+			}
+
+			guard.recordHistory(uuid, EventPeerOffline, &HistoryEntry{
+				Time:     offlineAt,
+				Endpoint: current.endpoint,
+			})
+		}
+
+		if last.endpoint != "" && current.endpoint != "" && last.endpoint != current.endpoint {
+			guard.recordHistory(uuid, EventPeerEndpoint, &HistoryEntry{
+				Time:             now,
+				Endpoint:         current.endpoint,
+				PreviousEndpoint: last.endpoint,
+			})
+		}
+	}
+
+	return nil
+}
+
+// watchNewPeer remembers a new peer as never having handshaken, so its first handshake is raised
+// even when it comes before the watcher has seen the peer
+func (guard *Guard) watchNewPeer(uuid string) {
+	guard.watchLock.Lock()
+	defer guard.watchLock.Unlock()
+
+	guard.watched[uuid] = watchedPeer{addedAt: time.Now()}
+}
+
+// recordHistory stores a connection event for the peer and raises it
+func (guard *Guard) recordHistory(uuid, eventType string, entry *HistoryEntry) {
+	entry.Type = eventType
+
+	err := guard.store.AddHistory(uuid, entry)
+	if err != nil {
+		fmt.Printf("Unable to record %s for %s: %s\n", eventType, uuid, err)
+	}
+
+	guard.emitFor(eventType, uuid)
+}
+
+// GetHistory returns up to limit of the peer's most recent connection events, newest first
+func (guard *Guard) GetHistory(uuid string, limit int) ([]*HistoryEntry, error) {
+	return guard.store.GetHistory(uuid, limit)
+}
+
+// emitFor raises an event for a peer known only by its uuid
+func (guard *Guard) emitFor(eventType, uuid string) {
+	peer, err := guard.getStoredPeer(uuid)
+	if err != nil {
+		fmt.Printf("Unable to raise %s event for %s: %s\n", eventType, uuid, err)
+		return
+	}
+
+	guard.emit(eventType, peer)
+}
@@ -0,0 +1,149 @@
+package guard
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordEvents collects every event the guard raises until the test ends
+func recordEvents(t *testing.T, guard *Guard) func() []PeerEvent {
+	t.Helper()
+
+	var events []PeerEvent
+	var lock sync.Mutex
+
+	remove := guard.AddListener(func(event PeerEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	})
+	t.Cleanup(remove)
+
+	return func() []PeerEvent {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]PeerEvent(nil), events...)
+	}
+}
+
+func countEvents(events []PeerEvent, eventType string) int {
+	count := 0
+	for _, event := range events {
+		if event.Type == eventType {
+			count++
+		}
+	}
+	return count
+}
+
+func TestWatchPeersFirstHandshakeOfNewPeer(t *testing.T) {
+	guard, wg, _ := createTestGuard(t)
+	events := recordEvents(t, guard)
+
+	// The watcher has already run once before the peer exists
+	if err := guard.WatchPeers(); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := CreatePeer(generatePublicKey(t), "test", "", "", 0, nil, map[string]string{})
+	if err := guard.SetPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	// It handshakes before the watcher next looks
+	wg.devices["wg0"].Peers[0].LastHandshakeTime = time.Now()
+
+	if err := guard.WatchPeers(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := countEvents(events(), EventPeerHandshake); got != 1 {
+		t.Errorf("%d firstHandshake events, want 1", got)
+	}
+	if got := countEvents(events(), EventPeerOnline); got != 1 {
+		t.Errorf("%d online events, want 1", got)
+	}
+
+	// Later snapshots don't raise it again
+	if err := guard.WatchPeers(); err != nil {
+		t.Fatal(err)
+	}
+	if got := countEvents(events(), EventPeerHandshake); got != 1 {
+		t.Errorf("%d firstHandshake events after another snapshot, want 1", got)
+	}
+}
+
+func TestWatchPeersKeepsPeersAddedDuringScan(t *testing.T) {
+	guard, _, _ := createTestGuard(t)
+
+	// Stands in for a peer remembered by watchNewPeer after the scan read the devices
+	guard.watched["late"] = watchedPeer{addedAt: time.Now().Add(time.Hour)}
+	guard.watched["gone"] = watchedPeer{addedAt: time.Now().Add(-time.Hour)}
+
+	if err := guard.WatchPeers(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := guard.watched["late"]; !ok {
+		t.Errorf("peer added during the scan was forgotten")
+	}
+	if _, ok := guard.watched["gone"]; ok {
+		t.Errorf("peer missing from the device was kept")
+	}
+}
+
+func TestWatchPeersHistory(t *testing.T) {
+	guard, wg, _ := createTestGuard(t)
+
+	peer := CreatePeer(generatePublicKey(t), "test", "", "", 0, nil, map[string]string{})
+	if err := guard.SetPeer(peer); err != nil {
+		t.Fatal(err)
+	}
+	devicePeer := &wg.devices["wg0"].Peers[0]
+
+	handshake := time.Now().Add(-time.Minute)
+	steps := []struct {
+		name          string
+		lastHandshake time.Time
+		endpoint      string
+	}{
+		{"comes online", handshake, "192.0.2.1:51820"},
+		{"still online", handshake.Add(30 * time.Second), "192.0.2.1:51820"},
+		{"roams", handshake.Add(30 * time.Second), "192.0.2.2:51820"},
+		{"session runs out", handshake.Add(-time.Hour), "192.0.2.2:51820"},
+	}
+	for _, step := range steps {
+		devicePeer.LastHandshakeTime = step.lastHandshake
+		devicePeer.Endpoint = net.UDPAddrFromAddrPort(netip.MustParseAddrPort(step.endpoint))
+
+		if err := guard.WatchPeers(); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+	}
+
+	history, err := guard.GetHistory(peer.Uuid, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest first
+	want := []HistoryEntry{
+		{Type: EventPeerOffline, Time: handshake.Add(-time.Hour + onlineTimeout), Endpoint: "192.0.2.2:51820"},
+		{Type: EventPeerEndpoint, Endpoint: "192.0.2.2:51820", PreviousEndpoint: "192.0.2.1:51820"},
+		{Type: EventPeerOnline, Time: handshake, Endpoint: "192.0.2.1:51820"},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("history = %+v, want %d entries", history, len(want))
+	}
+	for i, entry := range history {
+		if entry.Type != want[i].Type || entry.Endpoint != want[i].Endpoint || entry.PreviousEndpoint != want[i].PreviousEndpoint {
+			t.Errorf("entry %d = %+v, want %+v", i, entry, want[i])
+		}
+		if !want[i].Time.IsZero() && !entry.Time.Equal(want[i].Time) {
+			t.Errorf("entry %d at %s, want %s", i, entry.Time, want[i].Time)
+		}
+	}
+}
@@ -1,21 +1,34 @@
 package main
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/term"
 	"golang.zx2c4.com/wireguard/wgctrl"
 
 	"github.com/bob620/bakaguard/config"
 	"github.com/bob620/bakaguard/guard"
+	"github.com/bob620/bakaguard/metrics"
 	"github.com/bob620/bakaguard/ws"
 	"github.com/bob620/bakaguard/ws/state"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash" {
+		hashCommand(os.Args[2:])
+		return
+	}
+
 	wg, err := wgctrl.New()
 	if err != nil {
 		log.Fatal("unable to connect to wireguard")
@@ -23,6 +36,11 @@ func main() {
 
 	conf := config.LoadConfiguration()
 
+	err = state.ValidateCredentials(*conf.Websocket)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	devices, err := wg.Devices()
 	if err != nil {
 		log.Fatal("unable to access wireguard")
@@ -30,37 +48,94 @@ func main() {
 
 	fmt.Printf("Found %d Wireguard devices\n", len(devices))
 
-	_, err = wg.Device(conf.Interface.Name)
-	if os.IsNotExist(err) {
-		log.Fatal("Unable to find ", conf.Interface.Name)
-		//		fmt.Println("Making interface...")
-		//		privateKey, _ := wgtypes.GeneratePrivateKey()
-		//		wg.ConfigureDevice(conf.Interface.Name, wgtypes.Config{
-		//			PrivateKey:   &privateKey,
-		//			ListenPort:   nil,
-		//			FirewallMark: nil,
-		//			ReplacePeers: false,
-		//			Peers:        nil,
-		//		})
+	var store guard.PeerStore
+
+	switch conf.Store {
+	case "memory":
+		store = guard.CreateMemoryStore()
+		fmt.Println("Using in-memory peer store")
+	default:
+		redisPool := guard.CreateRedisPool(conf.Redis)
+
+		redisConn := redisPool.Get()
+		_, err = redisConn.Do("ping")
+		redisConn.Close()
+		if err != nil {
+			log.Fatal("unable to connect to redis database")
+		}
+
+		store = guard.CreateRedisStore(redisPool)
+		fmt.Println("Redis connected")
 	}
 
-	fmt.Println("Wireguard set up successfully")
+	guard := guard.CreateGuard(conf, wg, store)
 
-	redisConn, err := redis.Dial("tcp", fmt.Sprintf(":%d", conf.Redis.Port),
-		redis.DialDatabase(conf.Redis.Database),
-	)
+	// Interface and preshared keys are sealed with the secret, so nothing can be set up without it
+	err = guard.CheckSecretKey()
 	if err != nil {
-		log.Fatal("unable to connect to redis database")
+		log.Fatal(err)
 	}
 
-	fmt.Println("Redis connected")
+	err = guard.EnsureInterfaces()
+	if err != nil {
+		log.Fatal("Unable to set up interface ", err)
+	}
 
-	guard := guard.CreateGuard(conf, wg, redisConn)
-	err = guard.CleanupPeers()
+	err = guard.RestorePeers()
 	if err != nil {
 		fmt.Println(err)
 	}
 
+	fmt.Println("Wireguard set up successfully")
+
+	guard.Reconcile()
+
+	reconcileInterval, err := time.ParseDuration(conf.ReconcileInterval)
+	if err == nil && reconcileInterval > 0 {
+		guard.StartReconciler(reconcileInterval)
+		fmt.Println("Reconciling every", reconcileInterval)
+	}
+
+	expiryInterval, err := time.ParseDuration(conf.ExpiryInterval)
+	if err == nil && expiryInterval > 0 {
+		guard.StartExpirer(expiryInterval)
+		fmt.Println("Checking for expired peers every", expiryInterval)
+	}
+
+	staleInterval, err := time.ParseDuration(conf.StaleInterval)
+	if err == nil && staleInterval > 0 {
+		guard.StartStaleReaper(staleInterval)
+		fmt.Println("Checking for stale peers every", staleInterval)
+	}
+
+	trafficInterval, err := time.ParseDuration(conf.TrafficInterval)
+	if err == nil && trafficInterval > 0 {
+		guard.StartTrafficSampler(trafficInterval)
+		fmt.Println("Sampling traffic every", trafficInterval)
+	}
+
+	watchInterval, err := time.ParseDuration(conf.WatchInterval)
+	if err == nil && watchInterval > 0 {
+		guard.StartPeerWatcher(watchInterval)
+		fmt.Println("Watching peers every", watchInterval)
+	}
+
+	// Metrics name every peer, so they get their own listener that isn't reachable wherever the websocket is
+	if conf.MetricsAddress != "" {
+		prometheus.MustRegister(metrics.CreatePeerCollector(guard))
+
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+
+		go func() {
+			fmt.Println("Metrics listening on", conf.MetricsAddress)
+			err := http.ListenAndServe(conf.MetricsAddress, metricsMux)
+			if err != nil {
+				fmt.Println("Unable to serve metrics:", err)
+			}
+		}()
+	}
+
 	http.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
 		connState := state.InitializeConnState(*conf.Websocket)
 
@@ -71,3 +146,50 @@ func main() {
 	fmt.Println("Websocket listening on", conf.Websocket.Port)
 	_ = http.ListenAndServe(fmt.Sprintf(":%d", conf.Websocket.Port), nil)
 }
+
+// hashCommand prints a password hash for pasting into the config, the password is read from the terminal or stdin
+func hashCommand(args []string) {
+	flags := flag.NewFlagSet("hash", flag.ExitOnError)
+	algorithm := flags.String("algorithm", state.HashArgon2id, "hash algorithm, argon2id or bcrypt")
+	_ = flags.Parse(args)
+
+	var password string
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		first, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprint(os.Stderr, "Repeat password: ")
+		second, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if string(first) != string(second) {
+			log.Fatal("passwords do not match")
+		}
+		password = string(first)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if password == "" {
+		log.Fatal("password is empty")
+	}
+
+	hash, err := state.HashPassword(password, *algorithm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(hash)
+}
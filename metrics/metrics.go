@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "bakaguard"
+
+var (
+	RPCCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_calls_total",
+		Help:      "RPC calls handled, by method and whether they returned an error.",
+	}, []string{"method", "result"})
+
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Time taken to handle RPC calls, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Failed authentication attempts, by kind.",
+	}, []string{"kind"})
+
+	AuthLockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_lockouts_total",
+		Help:      "Lockouts after repeated failed authentication, by what was locked out: ip, user or admin.",
+	}, []string{"kind"})
+
+	AuthThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_throttled_total",
+		Help:      "Authentication attempts refused without checking because of backoff or lockout.",
+	})
+
+	StoreErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Commands sent to redis that failed.",
+	})
+
+	DeviceErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "wgctrl_errors_total",
+		Help:      "Calls to wireguard devices that failed.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(RPCCalls, RPCDuration, AuthFailures, AuthLockouts, AuthThrottled, StoreErrors, DeviceErrors)
+}
+
+// ObserveRPC records a finished RPC call of method that started at start
+func ObserveRPC(method string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	RPCCalls.WithLabelValues(method, result).Inc()
+	RPCDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
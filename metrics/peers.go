@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type InterfaceStats struct {
+	Name  string
+	Peers int
+}
+
+type PeerStats struct {
+	Uuid          string
+	Interface     string
+	Group         string
+	Name          string
+	LastHandshake time.Time
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// PeerSource is read on every scrape for the current state of the interfaces and their peers
+type PeerSource interface {
+	MetricsSnapshot() ([]InterfaceStats, []PeerStats, error)
+}
+
+var (
+	interfacePeersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "interface", "peers"),
+		"Peers configured on the interface.",
+		[]string{"interface"}, nil,
+	)
+	handshakeAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "peer", "handshake_age_seconds"),
+		"Seconds since the peer's last handshake, peers that never handshook are left out.",
+		[]string{"uuid", "interface", "group", "name"}, nil,
+	)
+	receiveBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "peer", "receive_bytes_total"),
+		"Bytes received from the peer since it was put on the interface.",
+		[]string{"uuid", "interface", "group", "name"}, nil,
+	)
+	transmitBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "peer", "transmit_bytes_total"),
+		"Bytes sent to the peer since it was put on the interface.",
+		[]string{"uuid", "interface", "group", "name"}, nil,
+	)
+)
+
+type peerCollector struct {
+	source PeerSource
+}
+
+// CreatePeerCollector exports the interfaces and peers of source
+func CreatePeerCollector(source PeerSource) prometheus.Collector {
+	return &peerCollector{
+		source: source,
+	}
+}
+
+func (collector *peerCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- interfacePeersDesc
+	descs <- handshakeAgeDesc
+	descs <- receiveBytesDesc
+	descs <- transmitBytesDesc
+}
+
+func (collector *peerCollector) Collect(metrics chan<- prometheus.Metric) {
+	ifaces, peers, err := collector.source.MetricsSnapshot()
+	if err != nil {
+		fmt.Println("Unable to collect peer metrics:", err)
+		return
+	}
+
+	for _, iface := range ifaces {
+		metrics <- prometheus.MustNewConstMetric(interfacePeersDesc, prometheus.GaugeValue, float64(iface.Peers), iface.Name)
+	}
+
+	now := time.Now()
+	for _, peer := range peers {
+		labels := []string{peer.Uuid, peer.Interface, peer.Group, peer.Name}
+
+		if !peer.LastHandshake.IsZero() {
+			metrics <- prometheus.MustNewConstMetric(handshakeAgeDesc, prometheus.GaugeValue, now.Sub(peer.LastHandshake).Seconds(), labels...)
+		}
+		metrics <- prometheus.MustNewConstMetric(receiveBytesDesc, prometheus.CounterValue, float64(peer.ReceiveBytes), labels...)
+		metrics <- prometheus.MustNewConstMetric(transmitBytesDesc, prometheus.CounterValue, float64(peer.TransmitBytes), labels...)
+	}
+}
@@ -0,0 +1,127 @@
+package ws
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/bob620/baka-rpc-go/parameters"
+
+	Guard "github.com/bob620/bakaguard/guard"
+)
+
+type auditTarget int
+
+const (
+	auditPeer auditTarget = iota
+	auditInterface
+	auditApiKey
+)
+
+// auditedMethods are the methods that change something, each is recorded with what it changed
+var auditedMethods = map[string]auditTarget{
+	"peers.add":                auditPeer,
+	"peers.generate":           auditPeer,
+	"peers.update":             auditPeer,
+	"peers.rotatePresharedKey": auditPeer,
+	"peers.disable":            auditPeer,
+	"peers.enable":             auditPeer,
+	"peers.delete":             auditPeer,
+	"interface.update":         auditInterface,
+	"apikeys.create":           auditApiKey,
+	"apikeys.revoke":           auditApiKey,
+}
+
+// audit runs handler, recording who called it and the target before and after.
+// Private keys and key secrets only appear in the result, which is never recorded.
+func (ws *WS) audit(method string, target auditTarget, params map[string]parameters.Param, handler func(map[string]parameters.Param) (json.RawMessage, error)) (json.RawMessage, error) {
+	entry := &Guard.AuditEntry{
+		Time:       time.Now(),
+		Identity:   ws.state.Identity(),
+		RemoteAddr: ws.remoteAddr,
+		Method:     method,
+	}
+
+	var id string
+	switch target {
+	case auditPeer:
+		id = stringParam(params, "uuid")
+	case auditInterface:
+		id = stringParam(params, "name")
+	case auditApiKey:
+		id = stringParam(params, "id")
+	}
+
+	if id != "" {
+		entry.Before = ws.snapshot(target, id)
+	}
+
+	result, err := handler(params)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	// Creating methods only know what they made from their result
+	if id == "" && err == nil {
+		created := struct {
+			Uuid string `json:"uuid"`
+			Id   string `json:"id"`
+		}{}
+		_ = json.Unmarshal(result, &created)
+
+		id = created.Uuid
+		if target == auditApiKey {
+			id = created.Id
+		}
+	}
+
+	if id != "" {
+		entry.After = ws.snapshot(target, id)
+	}
+
+	if target == auditPeer {
+		entry.Uuid = id
+	} else {
+		entry.Target = id
+	}
+
+	// Unauthenticated calls change nothing and would only fill the log
+	if entry.Identity != "" {
+		ws.guard.Audit(entry)
+	}
+
+	return result, err
+}
+
+// snapshot is the current state of a target as JSON, nil if it doesn't exist
+func (ws *WS) snapshot(target auditTarget, id string) json.RawMessage {
+	var value interface{}
+	var err error
+
+	switch target {
+	case auditPeer:
+		value, err = ws.guard.GetWgPeer(id)
+	case auditInterface:
+		value, err = ws.guard.GetInterface(id)
+	case auditApiKey:
+		value, err = ws.guard.GetApiKey(id)
+	}
+	if err != nil {
+		return nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func stringParam(params map[string]parameters.Param, name string) string {
+	param, ok := params[name].(*parameters.StringParam)
+	if !ok {
+		return ""
+	}
+
+	value, _ := param.GetString()
+	return value
+}
@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bob620/baka-rpc-go/parameters"
+
+	"github.com/bob620/bakaguard/config"
+	Guard "github.com/bob620/bakaguard/guard"
+	"github.com/bob620/bakaguard/ws/state"
+)
+
+func createAuditWs(t *testing.T) *WS {
+	t.Helper()
+
+	conf := config.Config{Websocket: &config.Websocket{
+		Groups: map[string]config.WSGroup{"test": {}},
+	}}
+
+	return &WS{
+		guard:      Guard.CreateGuard(conf, nil, Guard.CreateMemoryStore()),
+		state:      state.InitializeConnState(*conf.Websocket),
+		remoteAddr: "192.0.2.1",
+	}
+}
+
+func createApiKey(ws *WS) func(map[string]parameters.Param) (json.RawMessage, error) {
+	return func(map[string]parameters.Param) (json.RawMessage, error) {
+		secret, key, err := ws.guard.CreateApiKey("ci", map[string][]string{"test": {"peers.get"}}, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(CreatedApiKey{ApiKey: key, Key: secret})
+	}
+}
+
+func TestAuditRecordsChanges(t *testing.T) {
+	ws := createAuditWs(t)
+	ws.state.RestoreAdmin()
+
+	result, err := ws.audit("apikeys.create", auditApiKey, map[string]parameters.Param{}, createApiKey(ws))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ws.guard.QueryAudit(Guard.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d entries recorded, want 1", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Identity != "admin" || entry.RemoteAddr != "192.0.2.1" || entry.Method != "apikeys.create" {
+		t.Errorf("entry = %+v, want admin calling apikeys.create from 192.0.2.1", entry)
+	}
+
+	// The key is found from the result, but only the stored key is recorded, never its secret
+	created := CreatedApiKey{}
+	if err := json.Unmarshal(result, &created); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Target != created.Id || entry.Before != nil || entry.After == nil {
+		t.Errorf("entry = %+v, want the created key %s after", entry, created.Id)
+	}
+	if strings.Contains(string(entry.After), created.Key) {
+		t.Errorf("secret recorded in the audit log")
+	}
+}
+
+func TestAuditRecordsFailures(t *testing.T) {
+	ws := createAuditWs(t)
+	ws.state.RestoreAdmin()
+
+	_, err := ws.audit("apikeys.create", auditApiKey, map[string]parameters.Param{}, func(map[string]parameters.Param) (json.RawMessage, error) {
+		return nil, errors.New("unable to store api key")
+	})
+	if err == nil {
+		t.Fatal("handler error not returned")
+	}
+
+	entries, _ := ws.guard.QueryAudit(Guard.AuditFilter{})
+	if len(entries) != 1 || entries[0].Error != "unable to store api key" || entries[0].After != nil {
+		t.Errorf("entries = %+v, want the failure recorded", entries)
+	}
+}
+
+func TestAuditSkipsUnauthenticated(t *testing.T) {
+	ws := createAuditWs(t)
+
+	_, _ = ws.audit("apikeys.create", auditApiKey, map[string]parameters.Param{}, func(map[string]parameters.Param) (json.RawMessage, error) {
+		return nil, errors.New("please authenticate")
+	})
+
+	entries, _ := ws.guard.QueryAudit(Guard.AuditFilter{})
+	if len(entries) != 0 {
+		t.Errorf("%d entries recorded for an unauthenticated call", len(entries))
+	}
+}
@@ -0,0 +1,70 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+
+	Guard "github.com/bob620/bakaguard/guard"
+)
+
+// notificationBuffer is how many notifications can wait on a slow connection before new ones are dropped
+const notificationBuffer = 64
+
+const peerEventMethod = "peers.event"
+
+// subscribe sends every peer event accepted by filter to the connection until it closes or unsubscribes
+func (ws *WS) subscribe(guard *Guard.Guard, filter func(Guard.PeerEvent) bool) {
+	remove := guard.AddListener(func(event Guard.PeerEvent) {
+		if filter(event) {
+			ws.notify(peerEventMethod, event)
+		}
+	})
+
+	ws.subscribeLock.Lock()
+	defer ws.subscribeLock.Unlock()
+
+	ws.subscriptions = append(ws.subscriptions, remove)
+}
+
+func (ws *WS) unsubscribeAll() {
+	ws.subscribeLock.Lock()
+	defer ws.subscribeLock.Unlock()
+
+	for _, remove := range ws.subscriptions {
+		remove()
+	}
+	ws.subscriptions = nil
+}
+
+// notify queues a notification without waiting, events are raised while peers are being changed and can't block on a client
+func (ws *WS) notify(method string, params interface{}) {
+	data, err := json.Marshal(Notification{
+		JsonRpc: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return
+	}
+
+	select {
+	case ws.notifications <- data:
+	default:
+		fmt.Println("Dropped notification for a slow connection")
+	}
+}
+
+func (ws *WS) forwardNotifications(writer chan<- []byte) {
+	for {
+		select {
+		case <-ws.closed:
+			return
+		case data := <-ws.notifications:
+			select {
+			case writer <- data:
+			case <-ws.closed:
+				return
+			}
+		}
+	}
+}
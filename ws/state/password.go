@@ -0,0 +1,143 @@
+package state
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/bob620/bakaguard/config"
+)
+
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+// argon2id parameters for new hashes, the ones a hash was made with are read back from it
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 2
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// argonMaxMemory is the most memory in KiB a configured argon2id hash may ask for, past it every login could exhaust the host
+const argonMaxMemory = 4 * 1024 * 1024
+
+// dummyHash is checked against when a username doesn't exist and there is no configured hash to use instead
+var dummyHash, _ = HashPassword("bakaguard", HashBcrypt)
+
+// HashPassword hashes password with the given algorithm into a form CheckPassword and the config accept
+func HashPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+
+	case HashArgon2id:
+		salt := make([]byte, argonSaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argonMemory, argonTime, argonThreads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+
+	default:
+		return "", fmt.Errorf("unknown hash algorithm %s", algorithm)
+	}
+}
+
+// IsPasswordHash reports whether hash is a bcrypt or argon2id hash CheckPassword can verify against
+func IsPasswordHash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, _, _, _, _, err := parseArgon2id(hash)
+		return err == nil
+	}
+
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// CheckPassword verifies password against a bcrypt or argon2id hash in constant time
+func CheckPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		salt, key, memory, iterations, threads, err := parseArgon2id(hash)
+		if err != nil {
+			return false
+		}
+
+		attempt := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(attempt, key) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func parseArgon2id(hash string) (salt, key []byte, memory, iterations uint32, threads uint8, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, nil, 0, 0, 0, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, 0, 0, 0, fmt.Errorf("unsupported argon2id version")
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+	if err != nil {
+		return nil, nil, 0, 0, 0, fmt.Errorf("invalid argon2id parameters")
+	}
+
+	// argon2 panics on zero threads or iterations, and needs at least 8 KiB per thread
+	if threads == 0 || iterations == 0 || memory < 8*uint32(threads) || memory > argonMaxMemory {
+		return nil, nil, 0, 0, 0, fmt.Errorf("invalid argon2id parameters")
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, 0, 0, 0, fmt.Errorf("invalid argon2id salt")
+	}
+
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, 0, 0, 0, fmt.Errorf("invalid argon2id key")
+	}
+
+	return salt, key, memory, iterations, threads, nil
+}
+
+// ValidateCredentials checks every configured password is a usable hash, and that there is an admin one
+func ValidateCredentials(websocket config.Websocket) error {
+	if websocket.AdminPassword == "" {
+		return fmt.Errorf("ws.adminPassword is empty, set it to a hash from \"bakaguard hash\"")
+	}
+	if !IsPasswordHash(websocket.AdminPassword) {
+		return fmt.Errorf("ws.adminPassword is not a bcrypt or argon2id hash, make one with \"bakaguard hash\"")
+	}
+
+	for username, user := range websocket.Users {
+		if user.Password != "" && !IsPasswordHash(user.Password) {
+			return fmt.Errorf("password of user %s is not a bcrypt or argon2id hash, make one with \"bakaguard hash\"", username)
+		}
+	}
+
+	return nil
+}
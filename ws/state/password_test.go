@@ -0,0 +1,122 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/bob620/bakaguard/config"
+)
+
+func TestCheckPassword(t *testing.T) {
+	for _, algorithm := range []string{HashArgon2id, HashBcrypt} {
+		hash, err := HashPassword("correct horse", algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !IsPasswordHash(hash) {
+			t.Errorf("%s: IsPasswordHash(%q) = false", algorithm, hash)
+		}
+		if !CheckPassword(hash, "correct horse") {
+			t.Errorf("%s: right password refused", algorithm)
+		}
+		if CheckPassword(hash, "battery staple") {
+			t.Errorf("%s: wrong password accepted", algorithm)
+		}
+	}
+
+	if _, err := HashPassword("correct horse", "md5"); err == nil {
+		t.Errorf("hashed with an unknown algorithm")
+	}
+}
+
+func TestParseArgon2id(t *testing.T) {
+	const salt = "c29tZXNhbHRzb21lc2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	tests := []struct {
+		name  string
+		hash  string
+		valid bool
+	}{
+		{"valid", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$" + key, true},
+		{"zero threads", "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key, false},
+		{"zero iterations", "$argon2id$v=19$m=65536,t=0,p=2$" + salt + "$" + key, false},
+		{"zero memory", "$argon2id$v=19$m=0,t=3,p=2$" + salt + "$" + key, false},
+		{"too little memory per thread", "$argon2id$v=19$m=8,t=3,p=2$" + salt + "$" + key, false},
+		{"too much memory", "$argon2id$v=19$m=4294967295,t=3,p=2$" + salt + "$" + key, false},
+		{"wrong version", "$argon2id$v=16$m=65536,t=3,p=2$" + salt + "$" + key, false},
+		{"missing key", "$argon2id$v=19$m=65536,t=3,p=2$" + salt + "$", false},
+		{"bad salt", "$argon2id$v=19$m=65536,t=3,p=2$!!!$" + key, false},
+		{"too few parts", "$argon2id$v=19$m=65536,t=3,p=2$" + salt, false},
+		{"garbage parameters", "$argon2id$v=19$memory$" + salt + "$" + key, false},
+	}
+
+	for _, test := range tests {
+		_, _, _, _, _, err := parseArgon2id(test.hash)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: err = %v, want valid %t", test.name, err, test.valid)
+		}
+
+		// An unusable hash must be refused without panicking
+		if !test.valid && CheckPassword(test.hash, "anything") {
+			t.Errorf("%s: password accepted against an invalid hash", test.name)
+		}
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	hash, err := HashPassword("admin", HashBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		websocket config.Websocket
+		valid     bool
+	}{
+		{"hashed", config.Websocket{AdminPassword: hash, Users: map[string]config.WSUsers{"bob": {Password: hash}}}, true},
+		{"user without password", config.Websocket{AdminPassword: hash, Users: map[string]config.WSUsers{"bob": {}}}, true},
+		{"empty admin", config.Websocket{}, false},
+		{"plaintext admin", config.Websocket{AdminPassword: "admin"}, false},
+		{"plaintext user", config.Websocket{AdminPassword: hash, Users: map[string]config.WSUsers{"bob": {Password: "bob"}}}, false},
+		{"broken argon2id user", config.Websocket{AdminPassword: hash, Users: map[string]config.WSUsers{"bob": {Password: "$argon2id$v=19$m=65536,t=3,p=0$c2FsdA$a2V5"}}}, false},
+	}
+
+	for _, test := range tests {
+		err := ValidateCredentials(test.websocket)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: err = %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestDummyHashMatchesConfiguredAlgorithm(t *testing.T) {
+	argonHash, err := HashPassword("bob", HashArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := HashPassword("admin", HashBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := InitializeConnState(config.Websocket{
+		AdminPassword: bcryptHash,
+		Users:         map[string]config.WSUsers{"bob": {Password: argonHash}, "nopass": {}},
+	})
+
+	if state.dummyHash() != argonHash {
+		t.Errorf("unknown users aren't checked against the configured argon2id hash")
+	}
+
+	if state.TryUserLogin("mallory", "bob") {
+		t.Errorf("unknown user logged in with another user's password")
+	}
+	if state.TryUserLogin("nopass", "") {
+		t.Errorf("user without a password logged in")
+	}
+	if !state.TryUserLogin("bob", "bob") {
+		t.Errorf("bob refused with the right password")
+	}
+}
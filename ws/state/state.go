@@ -1,7 +1,7 @@
 package state
 
 import (
-	"net"
+	"sort"
 
 	"github.com/bob620/bakaguard/config"
 )
@@ -10,48 +10,42 @@ type State struct {
 	config     config.Websocket
 	authScopes map[string]map[string]struct{}
 	hasAdmin   bool
-}
-
-type Group struct {
-	Description string
-	Network     net.IPNet
+	username   string
+	apiKey     string
+	token      string
 }
 
 func InitializeConnState(config config.Websocket) *State {
 	return &State{
 		config:     config,
-		authScopes: map[string]map[string]struct{}{"auth.admin": {"*": {}}, "auth.user": {"*": {}}},
+		authScopes: initialScopes(),
 		hasAdmin:   false,
 	}
 }
 
-func (state *State) GetGroupSettings(groupName string) *Group {
-	group := state.config.Groups[groupName]
-
-	return &Group{
-		Description: group.Description,
-		Network: net.IPNet{
-			IP:   net.ParseIP(group.Network.IP),
-			Mask: net.IPv4Mask(group.Network.Mask[0], group.Network.Mask[1], group.Network.Mask[2], group.Network.Mask[3]),
-		},
-	}
+func initialScopes() map[string]map[string]struct{} {
+	return map[string]map[string]struct{}{"auth.admin": {"*": {}}, "auth.user": {"*": {}}}
 }
 
 func (state *State) HasAdminAuth() bool {
 	return state.hasAdmin
 }
 
+// GetScopeGroups returns a copy of the groups the connection has scope in, safe to keep after later logins grant more
 func (state *State) GetScopeGroups(scope string) map[string]struct{} {
 	if state.HasAdminAuth() {
 		return map[string]struct{}{"*": {}}
 	}
 
-	groups, _ := state.authScopes[scope]
+	groups := make(map[string]struct{}, len(state.authScopes[scope]))
+	for group := range state.authScopes[scope] {
+		groups[group] = struct{}{}
+	}
 	return groups
 }
 
 func (state *State) TryAdminPassword(password string) bool {
-	pass := state.config.AdminPassword == password
+	pass := CheckPassword(state.config.AdminPassword, password)
 	if pass {
 		state.hasAdmin = true
 	}
@@ -60,15 +54,111 @@ func (state *State) TryAdminPassword(password string) bool {
 }
 
 func (state *State) TryUserLogin(username, password string) bool {
-	user, _ := state.config.Users[username]
-	if user.Password == password {
-		for group, scopes := range user.Groups {
-			for _, scope := range scopes {
-				state.authScopes[scope][group] = struct{}{}
-			}
-		}
+	user, ok := state.config.Users[username]
+	if !ok || user.Password == "" {
+		// Still do the work of a check so unknown users can't be told apart by timing
+		CheckPassword(state.dummyHash(), password)
+		return false
+	}
+
+	if CheckPassword(user.Password, password) {
+		state.username = username
+		state.grantScopes(user.Groups)
 		return true
 	}
 
 	return false
 }
+
+// dummyHash is a configured hash to check unknown users against, so the check costs the same as for a real user.
+// Users are taken in name order so the same one is used every time.
+func (state *State) dummyHash() string {
+	usernames := make([]string, 0, len(state.config.Users))
+	for username := range state.config.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		if hash := state.config.Users[username].Password; IsPasswordHash(hash) {
+			return hash
+		}
+	}
+
+	if IsPasswordHash(state.config.AdminPassword) {
+		return state.config.AdminPassword
+	}
+	return dummyHash
+}
+
+func (state *State) grantScopes(groups map[string][]string) {
+	for group, scopes := range groups {
+		for _, scope := range scopes {
+			if state.authScopes[scope] == nil {
+				state.authScopes[scope] = map[string]struct{}{}
+			}
+			state.authScopes[scope][group] = struct{}{}
+		}
+	}
+}
+
+// RestoreAdmin grants admin from a session token instead of the password
+func (state *State) RestoreAdmin() {
+	state.hasAdmin = true
+}
+
+// RestoreUser grants a user's current scopes from a session token instead of their password.
+// A user removed from the config since the session started is refused.
+func (state *State) RestoreUser(username string) bool {
+	user, ok := state.config.Users[username]
+	if !ok || user.Password == "" {
+		return false
+	}
+
+	state.username = username
+	state.grantScopes(user.Groups)
+	return true
+}
+
+// GrantApiKey gives the connection the scopes of an api key
+func (state *State) GrantApiKey(id string, groups map[string][]string) {
+	state.apiKey = id
+	state.grantScopes(groups)
+}
+
+// Identity names who is logged in on the connection, for the audit log
+func (state *State) Identity() string {
+	switch {
+	case state.hasAdmin:
+		return "admin"
+	case state.username != "":
+		return "user:" + state.username
+	case state.apiKey != "":
+		return "apikey:" + state.apiKey
+	default:
+		return ""
+	}
+}
+
+// IsAuthenticated reports whether anything has been granted to the connection
+func (state *State) IsAuthenticated() bool {
+	return state.hasAdmin || state.username != "" || state.apiKey != ""
+}
+
+// Token is the session token the connection logged in with or was given
+func (state *State) Token() string {
+	return state.token
+}
+
+func (state *State) SetToken(token string) {
+	state.token = token
+}
+
+// Logout drops everything granted to the connection
+func (state *State) Logout() {
+	state.authScopes = initialScopes()
+	state.hasAdmin = false
+	state.username = ""
+	state.apiKey = ""
+	state.token = ""
+}
@@ -0,0 +1,42 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/bob620/bakaguard/config"
+)
+
+func TestRestoreUser(t *testing.T) {
+	state := InitializeConnState(config.Websocket{
+		Users: map[string]config.WSUsers{
+			"bob":    {Password: dummyHash, Groups: map[string][]string{"test": {"peers.get"}}},
+			"nopass": {Groups: map[string][]string{"test": {"peers.get"}}},
+		},
+	})
+
+	// Users removed from the config, or who can no longer log in, can't resume a session
+	for _, username := range []string{"alice", "nopass"} {
+		if state.RestoreUser(username) {
+			t.Errorf("restored a session for %s", username)
+		}
+	}
+	if state.IsAuthenticated() {
+		t.Fatal("authenticated after refused restores")
+	}
+
+	if !state.RestoreUser("bob") {
+		t.Fatal("bob's session refused")
+	}
+	if state.Identity() != "user:bob" {
+		t.Errorf("identity = %q, want user:bob", state.Identity())
+	}
+	if _, ok := state.GetScopeGroups("peers.get")["test"]; !ok {
+		t.Errorf("bob's scopes not granted")
+	}
+
+	state.SetToken("token")
+	state.Logout()
+	if state.IsAuthenticated() || state.Token() != "" || len(state.GetScopeGroups("peers.get")) != 0 {
+		t.Errorf("still logged in after logout")
+	}
+}
@@ -1,5 +1,53 @@
 package ws
 
+import (
+	"time"
+
+	Guard "github.com/bob620/bakaguard/guard"
+)
+
 type Auth struct {
 	Authenticated bool `json:"auth"`
+	// Token resumes the session on another connection through auth.token until ExpiresAt
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type GeneratedPeer struct {
+	*Guard.Peer
+	ClientConfig
+	PrivateKey string `json:"privateKey"`
+}
+
+type ClientConfig struct {
+	Config string `json:"config"`
+	// QRCode is PNG data, base64 encoded in the response
+	QRCode     []byte `json:"qr,omitempty"`
+	QRCodeText string `json:"qrText,omitempty"`
+}
+
+type CreatedApiKey struct {
+	*Guard.ApiKey
+	Key string `json:"key"`
+}
+
+type PeerTraffic struct {
+	*Guard.Peer
+	Traffic *Guard.TrafficStats `json:"traffic"`
+}
+
+type PeerHistory struct {
+	*Guard.Peer
+	History []*Guard.HistoryEntry `json:"history"`
+}
+
+type Subscribed struct {
+	Subscribed bool `json:"subscribed"`
+}
+
+// Notification is a JSON-RPC request without an id, the client isn't expected to answer it
+type Notification struct {
+	JsonRpc string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
 }
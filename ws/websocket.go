@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bob620/baka-rpc-go/parameters"
@@ -12,35 +14,59 @@ import (
 	"github.com/gorilla/websocket"
 
 	Guard "github.com/bob620/bakaguard/guard"
+	"github.com/bob620/bakaguard/metrics"
 	"github.com/bob620/bakaguard/ws/state"
 )
 
 var upgrader = websocket.Upgrader{}
-var rpcClient = rpc.CreateBakaRpc(nil, nil)
 
 type WS struct {
-	client *rpc.BakaRpc
+	client        *rpc.BakaRpc
+	guard         *Guard.Guard
+	state         *state.State
+	remoteAddr    string
+	notifications chan []byte
+	closed        chan struct{}
+	subscriptions []func()
+	subscribeLock sync.Mutex
 }
 
-func CreateWs(guard *Guard.Guard, state *state.State) WS {
-	ws := WS{rpcClient}
+// CreateWs builds the RPC client for a single connection, its methods answer with that connection's state
+func CreateWs(guard *Guard.Guard, state *state.State) *WS {
+	ws := &WS{
+		client:        rpc.CreateBakaRpc(nil, nil),
+		guard:         guard,
+		state:         state,
+		notifications: make(chan []byte, notificationBuffer),
+		closed:        make(chan struct{}),
+	}
 
-	rpcClient.RegisterMethod(
+	ws.registerMethod(
 		"auth.admin",
 		[]parameters.Param{
 			&parameters.StringParam{Name: "password", Required: true},
 		},
 		func(params map[string]parameters.Param) (json.RawMessage, error) {
 			if state.HasAdminAuth() {
-				return json.Marshal(Auth{true})
+				return json.Marshal(Auth{Authenticated: true})
 			}
 
 			password, _ := params["password"].(*parameters.StringParam).GetString()
 
-			return json.Marshal(Auth{state.TryAdminPassword(password)})
+			authenticated, err := ws.limitAuth("admin", "admin", func() bool {
+				return state.TryAdminPassword(password)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !authenticated {
+				return json.Marshal(Auth{Authenticated: false})
+			}
+
+			return json.Marshal(startSession(guard, state, true, ""))
 		})
 
-	rpcClient.RegisterMethod(
+	ws.registerMethod(
 		"auth.user",
 		[]parameters.Param{
 			&parameters.StringParam{Name: "username", Required: true},
@@ -50,10 +76,105 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 			username, _ := params["username"].(*parameters.StringParam).GetString()
 			password, _ := params["password"].(*parameters.StringParam).GetString()
 
-			return json.Marshal(Auth{state.TryUserLogin(username, password)})
+			authenticated, err := ws.limitAuth("user", "user:"+username, func() bool {
+				return state.TryUserLogin(username, password)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !authenticated {
+				return json.Marshal(Auth{Authenticated: false})
+			}
+
+			return json.Marshal(startSession(guard, state, false, username))
+		})
+
+	ws.registerMethod(
+		"auth.token",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "token", Required: true},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			token, _ := params["token"].(*parameters.StringParam).GetString()
+
+			var session *Guard.Session
+			authenticated, err := ws.limitAuth("token", "", func() bool {
+				var err error
+				session, err = guard.GetSession(token)
+				if err != nil {
+					return false
+				}
+
+				if session.Admin {
+					state.RestoreAdmin()
+					return true
+				}
+				return state.RestoreUser(session.Username)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !authenticated {
+				return json.Marshal(Auth{Authenticated: false})
+			}
+
+			state.SetToken(token)
+			return json.Marshal(Auth{Authenticated: true, Token: token, ExpiresAt: &session.ExpiresAt})
+		})
+
+	ws.registerMethod(
+		"auth.key",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "key", Required: true},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			secret, _ := params["key"].(*parameters.StringParam).GetString()
+
+			var key *Guard.ApiKey
+			authenticated, err := ws.limitAuth("key", "", func() bool {
+				var err error
+				key, err = guard.AuthenticateApiKey(secret)
+				return err == nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !authenticated {
+				return json.Marshal(Auth{Authenticated: false})
+			}
+
+			state.GrantApiKey(key.Id, key.Groups)
+			return json.Marshal(Auth{Authenticated: true})
+		})
+
+	ws.registerMethod(
+		"auth.logout",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "token"},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			token, _ := params["token"].(*parameters.StringParam).GetString()
+			if token == "" {
+				token = state.Token()
+			}
+
+			if token != "" {
+				err := guard.DeleteSession(token)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// Subscriptions were filtered by the scopes being dropped, so they go with them
+			if token == state.Token() {
+				state.Logout()
+				ws.unsubscribeAll()
+			}
+
+			return json.Marshal(Auth{Authenticated: state.IsAuthenticated()})
 		})
 
-	rpcClient.RegisterMethod(
+	ws.registerMethod(
 		"peers.get",
 		[]parameters.Param{
 			&parameters.StringParam{Name: "uuid", Required: true},
@@ -80,7 +201,7 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 			return nil, fmt.Errorf("peer not found")
 		})
 
-	rpcClient.RegisterMethod(
+	ws.registerMethod(
 		"peers.all",
 		[]parameters.Param{},
 		func(params map[string]parameters.Param) (json.RawMessage, error) {
@@ -114,7 +235,7 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 			return json.Marshal(peers)
 		})
 
-	rpcClient.RegisterMethod(
+	ws.registerMethod(
 		"peers.getGroup",
 		[]parameters.Param{
 			&parameters.StringParam{Name: "group", Required: true},
@@ -141,13 +262,16 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 			return json.Marshal(peers)
 		})
 
-	rpcClient.RegisterMethod(
+	ws.registerMethod(
 		"peers.update",
 		[]parameters.Param{
 			&parameters.StringParam{Name: "uuid", Required: true},
 			&parameters.StringParam{Name: "name"},
 			&parameters.StringParam{Name: "description"},
 			&parameters.StringParam{Name: "keepAlive", Default: "-1s"},
+			&parameters.StringParam{Name: "endpoint"},
+			&parameters.StringParam{Name: "expiresAt"},
+			&parameters.StringParam{Name: "ttl"},
 			&InterfaceParam{Name: "storage", Default: map[string]interface{}{}},
 			&IPNetParam{Name: "allowedIPs", Default: []net.IPNet{}},
 		},
@@ -162,15 +286,17 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 			name, _ := params["name"].(*parameters.StringParam).GetString()
 			desc, _ := params["description"].(*parameters.StringParam).GetString()
 			keepAlive, _ := params["keepAlive"].(*parameters.StringParam).GetString()
+			endpoint, _ := params["endpoint"].(*parameters.StringParam).GetString()
 			allowedIPs, _ := params["allowedIPs"].(*IPNetParam).GetIPNet()
 			storage, _ := params["storage"].(*InterfaceParam).GetInterface()
 
-			fmt.Println("Looking up peer")
+			expiresAt, setExpiry, err := parseExpiry(params)
+			if err != nil {
+				return nil, err
+			}
 
 			peer, err := guard.GetWgPeer(uuid)
 			if err != nil {
-				fmt.Print("1: ")
-				fmt.Println(err)
 				return nil, err
 			}
 
@@ -178,7 +304,6 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 			_, adminOk := validGroups["*"]
 
 			if !ok && !adminOk {
-				fmt.Println("peer not found")
 				return nil, fmt.Errorf("peer not found")
 			}
 
@@ -194,6 +319,13 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 				peer.KeepAlive, _ = time.ParseDuration(keepAlive)
 			}
 
+			// Empty leaves the endpoint alone, "none" clears it so the peer roams again
+			if endpoint == "none" {
+				peer.Endpoint = ""
+			} else if endpoint != "" {
+				peer.Endpoint = endpoint
+			}
+
 			if len(allowedIPs) > 0 {
 				peer.AllowedIPs = allowedIPs
 			}
@@ -202,18 +334,19 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 				peer.Storage = guard.FormatUpdateStorage(peer.Storage, storage)
 			}
 
-			fmt.Println("Attempting to update peer...")
+			if setExpiry {
+				peer.ExpiresAt = expiresAt
+			}
+
 			err = guard.UpdatePeer(peer)
 			if err != nil {
-				fmt.Print("2: ")
-				fmt.Println(err)
 				return nil, err
 			}
-			fmt.Println("Peer updated")
+
 			return json.Marshal(peer)
 		})
 
-	rpcClient.RegisterMethod(
+	ws.registerMethod(
 		"peers.add",
 		[]parameters.Param{
 			&parameters.StringParam{Name: "publicKey", Required: true},
@@ -221,62 +354,156 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 			&parameters.StringParam{Name: "name"},
 			&parameters.StringParam{Name: "description"},
 			&parameters.StringParam{Name: "keepAlive", Default: "-1s"},
+			&parameters.StringParam{Name: "presharedKey"},
+			&parameters.StringParam{Name: "endpoint"},
+			&parameters.StringParam{Name: "expiresAt"},
+			&parameters.StringParam{Name: "ttl"},
+			&InterfaceParam{Name: "storage", Default: map[string]interface{}{}},
+			&IPNetParam{Name: "allowedIPs", Default: []net.IPNet{}},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			publicKey, _ := params["publicKey"].(*parameters.StringParam).GetString()
+
+			peer, err := addPeer(guard, state, "peers.add", publicKey, params)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(peer)
+		})
+
+	ws.registerMethod(
+		"peers.generate",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "group", Required: true},
+			&parameters.StringParam{Name: "qr", Default: "false"},
+			&parameters.StringParam{Name: "name"},
+			&parameters.StringParam{Name: "description"},
+			&parameters.StringParam{Name: "keepAlive", Default: "-1s"},
+			&parameters.StringParam{Name: "presharedKey"},
+			&parameters.StringParam{Name: "endpoint"},
+			&parameters.StringParam{Name: "expiresAt"},
+			&parameters.StringParam{Name: "ttl"},
 			&InterfaceParam{Name: "storage", Default: map[string]interface{}{}},
 			&IPNetParam{Name: "allowedIPs", Default: []net.IPNet{}},
 		},
 		func(params map[string]parameters.Param) (json.RawMessage, error) {
-			validGroups := state.GetScopeGroups("peers.add")
+			privateKey, publicKey, err := Guard.GenerateKeyPair()
+			if err != nil {
+				return nil, err
+			}
+
+			peer, err := addPeer(guard, state, "peers.generate", publicKey, params)
+			if err != nil {
+				return nil, err
+			}
+
+			qr, _ := params["qr"].(*parameters.StringParam).GetString()
+			response := GeneratedPeer{Peer: peer, PrivateKey: privateKey}
+
+			response.Config, err = guard.RenderClientConfig(peer, privateKey)
+			if err == nil && qr == "true" {
+				response.QRCode, response.QRCodeText, err = Guard.RenderQRCode(response.Config, 512)
+			}
+
+			// The private key is lost with the response, so a peer the client can't be given a config for goes too
+			if err != nil {
+				deleteErr := guard.DeletePeer(peer.Uuid)
+				if deleteErr != nil {
+					fmt.Printf("Unable to remove peer %s after its config failed: %s\n", peer.Uuid, deleteErr)
+				}
+				return nil, err
+			}
+
+			// This is the only time the private key leaves bakaguard, it is never stored
+			return json.Marshal(response)
+		})
+
+	ws.registerMethod(
+		"peers.config",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "uuid", Required: true},
+			&parameters.StringParam{Name: "qr", Default: "false"},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			validGroups := state.GetScopeGroups("peers.config")
 
 			if len(validGroups) == 0 {
 				return nil, fmt.Errorf("please authenticate")
 			}
 
-			publicKey, _ := params["publicKey"].(*parameters.StringParam).GetString()
-			group, _ := params["group"].(*parameters.StringParam).GetString()
-			name, _ := params["name"].(*parameters.StringParam).GetString()
-			desc, _ := params["description"].(*parameters.StringParam).GetString()
-			keepAlive, _ := params["keepAlive"].(*parameters.StringParam).GetString()
-			allowedIPs, _ := params["allowedIPs"].(*IPNetParam).GetIPNet()
-			storage, _ := params["storage"].(*InterfaceParam).GetInterface()
+			uuid, _ := params["uuid"].(*parameters.StringParam).GetString()
+			qr, _ := params["qr"].(*parameters.StringParam).GetString()
 
-			_, ok := validGroups[group]
+			peer, err := guard.GetWgPeer(uuid)
+			if err != nil {
+				return nil, err
+			}
+
+			_, ok := validGroups[peer.Group]
 			_, adminOk := validGroups["*"]
 
 			if !ok && !adminOk {
+				return nil, fmt.Errorf("peer not found")
+			}
+
+			// Without the private key the code would import a tunnel that can't connect
+			if qr == "true" {
+				return nil, fmt.Errorf("qr codes are only available from peers.generate, the private key is never stored")
+			}
+
+			clientConfig, err := guard.RenderClientConfig(peer, "")
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(ClientConfig{Config: clientConfig})
+		})
+
+	ws.registerMethod(
+		"peers.rotatePresharedKey",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "uuid", Required: true},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			validGroups := state.GetScopeGroups("peers.rotatePresharedKey")
+
+			if len(validGroups) == 0 {
 				return nil, fmt.Errorf("please authenticate")
 			}
 
-			keepAliveDuration := time.Duration(0)
+			uuid, _ := params["uuid"].(*parameters.StringParam).GetString()
+			peer, err := guard.GetWgPeer(uuid)
+			if err != nil {
+				return nil, err
+			}
 
-			if keepAlive != "-1s" {
-				keepAliveDuration, _ = time.ParseDuration(keepAlive)
+			_, ok := validGroups[peer.Group]
+			_, adminOk := validGroups["*"]
+
+			if !ok && !adminOk {
+				return nil, fmt.Errorf("peer not found")
 			}
 
-			peer := Guard.CreatePeer(
-				publicKey,
-				group,
-				name,
-				desc,
-				keepAliveDuration,
-				append(allowedIPs, state.GetGroupSettings(group).Network),
-				guard.FormatUpdateStorage(nil, storage),
-			)
+			peer, err = guard.RotatePresharedKey(uuid)
+			if err != nil {
+				return nil, err
+			}
 
-			err := guard.SetPeer(peer)
+			// The new key has to reach the client, and the config is the only place it is shown
+			clientConfig, err := guard.RenderClientConfig(peer, "")
 			if err != nil {
-				fmt.Println(err)
 				return nil, err
 			}
-			return json.Marshal(peer)
+			return json.Marshal(ClientConfig{Config: clientConfig})
 		})
 
-	rpcClient.RegisterMethod(
-		"peers.delete",
+	ws.registerMethod(
+		"peers.disable",
 		[]parameters.Param{
 			&parameters.StringParam{Name: "uuid", Required: true},
 		},
 		func(params map[string]parameters.Param) (json.RawMessage, error) {
-			validGroups := state.GetScopeGroups("peers.delete")
+			validGroups := state.GetScopeGroups("peers.disable")
 
 			if len(validGroups) == 0 {
 				return nil, fmt.Errorf("please authenticate")
@@ -285,33 +512,707 @@ func CreateWs(guard *Guard.Guard, state *state.State) WS {
 			uuid, _ := params["uuid"].(*parameters.StringParam).GetString()
 			peer, err := guard.GetWgPeer(uuid)
 			if err != nil {
-				return json.Marshal([]byte(`{"done":true}`))
+				return nil, err
 			}
 
 			_, ok := validGroups[peer.Group]
 			_, adminOk := validGroups["*"]
 
 			if !ok && !adminOk {
+				return nil, fmt.Errorf("peer not found")
+			}
+
+			peer, err = guard.DisablePeer(uuid)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(peer)
+		})
+
+	ws.registerMethod(
+		"peers.enable",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "uuid", Required: true},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			validGroups := state.GetScopeGroups("peers.enable")
+
+			if len(validGroups) == 0 {
 				return nil, fmt.Errorf("please authenticate")
 			}
 
-			err = guard.DeletePeer(uuid)
+			uuid, _ := params["uuid"].(*parameters.StringParam).GetString()
+			peer, err := guard.GetWgPeer(uuid)
 			if err != nil {
 				return nil, err
 			}
 
-			return json.Marshal([]byte(`{"done":true}`))
+			_, ok := validGroups[peer.Group]
+			_, adminOk := validGroups["*"]
+
+			if !ok && !adminOk {
+				return nil, fmt.Errorf("peer not found")
+			}
+
+			peer, err = guard.EnablePeer(uuid)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(peer)
 		})
 
-	return ws
-}
+	ws.registerMethod(
+		"peers.stale",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "group"},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			validGroups := state.GetScopeGroups("peers.stale")
 
-func (ws *WS) Handler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		return
-	}
+			if len(validGroups) == 0 {
+				return nil, fmt.Errorf("please authenticate")
+			}
 
-	defer conn.Close()
-	ws.client.UseChannels(rpc.MakeSocketReaderChan(conn), rpc.MakeSocketWriterChan(conn))
+			group, _ := params["group"].(*parameters.StringParam).GetString()
+			_, adminOk := validGroups["*"]
+
+			groups := map[string]struct{}{}
+			switch {
+			case group != "":
+				if _, ok := validGroups[group]; ok || adminOk {
+					groups[group] = struct{}{}
+				}
+			case adminOk:
+				for _, name := range guard.GroupNames() {
+					groups[name] = struct{}{}
+				}
+			default:
+				for name := range validGroups {
+					groups[name] = struct{}{}
+				}
+			}
+
+			peers := map[string]*Guard.Peer{}
+			for name := range groups {
+				stalePeers, err := guard.GetStalePeers(name)
+				if err != nil {
+					return nil, err
+				}
+
+				for peerUuid, peer := range stalePeers {
+					peers[peerUuid] = peer
+				}
+			}
+
+			return json.Marshal(peers)
+		})
+
+	ws.registerMethod(
+		"peers.staleActions",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "limit", Default: "100"},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			if !state.HasAdminAuth() {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			limitString, _ := params["limit"].(*parameters.StringParam).GetString()
+			limit, err := strconv.Atoi(limitString)
+			if err != nil || limit <= 0 {
+				return nil, fmt.Errorf("invalid limit")
+			}
+
+			actions, err := guard.GetStaleActions(limit)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(actions)
+		})
+
+	ws.registerMethod(
+		"peers.traffic",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "uuid", Required: true},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			validGroups := state.GetScopeGroups("peers.traffic")
+
+			if len(validGroups) == 0 {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			uuid, _ := params["uuid"].(*parameters.StringParam).GetString()
+			peer, err := guard.GetWgPeer(uuid)
+			if err != nil {
+				return nil, err
+			}
+
+			_, ok := validGroups[peer.Group]
+			_, adminOk := validGroups["*"]
+
+			if !ok && !adminOk {
+				return nil, fmt.Errorf("peer not found")
+			}
+
+			traffic, err := guard.GetPeerTraffic(uuid)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(PeerTraffic{Peer: peer, Traffic: traffic})
+		})
+
+	ws.registerMethod(
+		"peers.groupTraffic",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "group", Required: true},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			validGroups := state.GetScopeGroups("peers.traffic")
+
+			if len(validGroups) == 0 {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			group, _ := params["group"].(*parameters.StringParam).GetString()
+			_, ok := validGroups[group]
+			_, adminOk := validGroups["*"]
+
+			if !ok && !adminOk {
+				return nil, fmt.Errorf("group not found")
+			}
+
+			traffic, err := guard.GetGroupTraffic(group)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(traffic)
+		})
+
+	ws.registerMethod(
+		"peers.history",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "uuid", Required: true},
+			&parameters.StringParam{Name: "limit", Default: "100"},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			validGroups := state.GetScopeGroups("peers.history")
+
+			if len(validGroups) == 0 {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			uuid, _ := params["uuid"].(*parameters.StringParam).GetString()
+			limitString, _ := params["limit"].(*parameters.StringParam).GetString()
+
+			limit, err := strconv.Atoi(limitString)
+			if err != nil || limit <= 0 {
+				return nil, fmt.Errorf("invalid limit")
+			}
+
+			peer, err := guard.GetWgPeer(uuid)
+			if err != nil {
+				return nil, err
+			}
+
+			_, ok := validGroups[peer.Group]
+			_, adminOk := validGroups["*"]
+
+			if !ok && !adminOk {
+				return nil, fmt.Errorf("peer not found")
+			}
+
+			history, err := guard.GetHistory(uuid, limit)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(PeerHistory{Peer: peer, History: history})
+		})
+
+	ws.registerMethod(
+		"peers.subscribe",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "group"},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			validGroups := state.GetScopeGroups("peers.subscribe")
+
+			if len(validGroups) == 0 {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			group, _ := params["group"].(*parameters.StringParam).GetString()
+			_, ok := validGroups[group]
+			_, adminOk := validGroups["*"]
+
+			if group != "" && !ok && !adminOk {
+				return nil, fmt.Errorf("group not found")
+			}
+
+			ws.subscribe(guard, func(event Guard.PeerEvent) bool {
+				if group != "" && event.Group != group {
+					return false
+				}
+
+				_, ok := validGroups[event.Group]
+				return ok || adminOk
+			})
+
+			return json.Marshal(Subscribed{true})
+		})
+
+	ws.registerMethod(
+		"peers.unsubscribe",
+		[]parameters.Param{},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			ws.unsubscribeAll()
+			return json.Marshal(Subscribed{false})
+		})
+
+	ws.registerMethod(
+		"peers.delete",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "uuid", Required: true},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			validGroups := state.GetScopeGroups("peers.delete")
+
+			if len(validGroups) == 0 {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			uuid, _ := params["uuid"].(*parameters.StringParam).GetString()
+			peer, err := guard.GetWgPeer(uuid)
+			if err != nil {
+				return json.Marshal([]byte(`{"done":true}`))
+			}
+
+			_, ok := validGroups[peer.Group]
+			_, adminOk := validGroups["*"]
+
+			if !ok && !adminOk {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			err = guard.DeletePeer(uuid)
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal([]byte(`{"done":true}`))
+		})
+
+	ws.registerMethod(
+		"apikeys.create",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "name", Required: true},
+			&InterfaceParam{Name: "groups", Required: true},
+			&parameters.StringParam{Name: "expiresAt"},
+			&parameters.StringParam{Name: "ttl"},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			if !state.HasAdminAuth() {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			name, _ := params["name"].(*parameters.StringParam).GetString()
+			groupParam, _ := params["groups"].(*InterfaceParam).GetInterface()
+
+			expiresAt, _, err := parseExpiry(params)
+			if err != nil {
+				return nil, err
+			}
+
+			groups, err := parseGroupScopes(groupParam)
+			if err != nil {
+				return nil, err
+			}
+
+			secret, key, err := guard.CreateApiKey(name, groups, expiresAt)
+			if err != nil {
+				return nil, err
+			}
+
+			// This is the only time the key is shown, only its hash is stored
+			return json.Marshal(CreatedApiKey{ApiKey: key, Key: secret})
+		})
+
+	ws.registerMethod(
+		"apikeys.list",
+		[]parameters.Param{},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			if !state.HasAdminAuth() {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			keys, err := guard.GetApiKeys()
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(keys)
+		})
+
+	ws.registerMethod(
+		"apikeys.revoke",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "id", Required: true},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			if !state.HasAdminAuth() {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			id, _ := params["id"].(*parameters.StringParam).GetString()
+
+			err := guard.RevokeApiKey(id)
+			if err != nil {
+				return nil, err
+			}
+
+			return json.RawMessage(`{"done":true}`), nil
+		})
+
+	ws.registerMethod(
+		"audit.query",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "since"},
+			&parameters.StringParam{Name: "until"},
+			&parameters.StringParam{Name: "identity"},
+			&parameters.StringParam{Name: "uuid"},
+			&parameters.StringParam{Name: "limit", Default: "100"},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			if !state.HasAdminAuth() {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			since, _ := params["since"].(*parameters.StringParam).GetString()
+			until, _ := params["until"].(*parameters.StringParam).GetString()
+			identity, _ := params["identity"].(*parameters.StringParam).GetString()
+			uuid, _ := params["uuid"].(*parameters.StringParam).GetString()
+			limitString, _ := params["limit"].(*parameters.StringParam).GetString()
+
+			filter := Guard.AuditFilter{Identity: identity, Uuid: uuid}
+
+			var err error
+			if since != "" {
+				filter.Since, err = time.Parse(time.RFC3339, since)
+				if err != nil {
+					return nil, fmt.Errorf("invalid since")
+				}
+			}
+
+			if until != "" {
+				filter.Until, err = time.Parse(time.RFC3339, until)
+				if err != nil {
+					return nil, fmt.Errorf("invalid until")
+				}
+			}
+
+			filter.Limit, err = strconv.Atoi(limitString)
+			if err != nil || filter.Limit <= 0 {
+				return nil, fmt.Errorf("invalid limit")
+			}
+
+			entries, err := guard.QueryAudit(filter)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(entries)
+		})
+
+	ws.registerMethod(
+		"reconcile.last",
+		[]parameters.Param{},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			if !state.HasAdminAuth() {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			return json.Marshal(guard.LastReconcile())
+		})
+
+	ws.registerMethod(
+		"interface.all",
+		[]parameters.Param{},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			if !state.HasAdminAuth() {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			ifaces, err := guard.GetInterfaces()
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(ifaces)
+		})
+
+	ws.registerMethod(
+		"interface.get",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "name", Required: true},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			if !state.HasAdminAuth() {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			name, _ := params["name"].(*parameters.StringParam).GetString()
+
+			iface, err := guard.GetInterface(name)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(iface)
+		})
+
+	ws.registerMethod(
+		"interface.update",
+		[]parameters.Param{
+			&parameters.StringParam{Name: "name", Required: true},
+			&parameters.StringParam{Name: "listenPort"},
+			&parameters.StringParam{Name: "firewallMark"},
+			&parameters.StringParam{Name: "generateKey", Default: "false"},
+		},
+		func(params map[string]parameters.Param) (json.RawMessage, error) {
+			if !state.HasAdminAuth() {
+				return nil, fmt.Errorf("please authenticate")
+			}
+
+			name, _ := params["name"].(*parameters.StringParam).GetString()
+			listenPortString, _ := params["listenPort"].(*parameters.StringParam).GetString()
+			firewallMarkString, _ := params["firewallMark"].(*parameters.StringParam).GetString()
+			generateKey, _ := params["generateKey"].(*parameters.StringParam).GetString()
+
+			var listenPort, firewallMark *int
+
+			if listenPortString != "" {
+				port, err := strconv.Atoi(listenPortString)
+				if err != nil || port < 0 || port > 65535 {
+					return nil, fmt.Errorf("invalid listenPort")
+				}
+				listenPort = &port
+			}
+
+			if firewallMarkString != "" {
+				mark, err := strconv.Atoi(firewallMarkString)
+				if err != nil || mark < 0 {
+					return nil, fmt.Errorf("invalid firewallMark")
+				}
+				firewallMark = &mark
+			}
+
+			iface, err := guard.UpdateInterface(name, listenPort, firewallMark, generateKey == "true")
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(iface)
+		})
+
+	return ws
+}
+
+// limitAuth runs an authentication attempt unless the caller's address or the account is backing off or locked out,
+// or already has too many attempts in progress. Failures are counted against both, on success only the account's are forgotten.
+// Attempts that don't name an account, like tokens and api keys, are only limited by address.
+func (ws *WS) limitAuth(kind, account string, try func() bool) (bool, error) {
+	limiter := ws.guard.AuthLimiter()
+
+	host, _, err := net.SplitHostPort(ws.remoteAddr)
+	if err != nil {
+		host = ws.remoteAddr
+	}
+
+	keys := []string{Guard.AddressKey(host)}
+	if account != "" {
+		keys = append(keys, account)
+	}
+
+	wait, ok := limiter.Reserve(keys...)
+	if !ok {
+		metrics.AuthThrottled.Inc()
+		if wait > 0 {
+			return false, fmt.Errorf("too many failed attempts, try again in %s", wait.Round(time.Second))
+		}
+		return false, fmt.Errorf("too many login attempts in progress, try again shortly")
+	}
+
+	if !try() {
+		metrics.AuthFailures.WithLabelValues(kind).Inc()
+		limiter.Fail(keys...)
+		return false, nil
+	}
+
+	limiter.Succeed(keys...)
+	return true, nil
+}
+
+// startSession gives a connection that just logged in a token it can resume with.
+// Failing to store one doesn't undo the login, the client only has to send its password again next time.
+func startSession(guard *Guard.Guard, state *state.State, admin bool, username string) Auth {
+	token, session, err := guard.CreateSession(admin, username)
+	if err != nil {
+		fmt.Println("Unable to start session:", err)
+		return Auth{Authenticated: true}
+	}
+
+	state.SetToken(token)
+	return Auth{Authenticated: true, Token: token, ExpiresAt: &session.ExpiresAt}
+}
+
+// parseGroupScopes reads a group -> scopes mapping in the same shape as a user's groups
+func parseGroupScopes(param map[string]interface{}) (map[string][]string, error) {
+	groups := make(map[string][]string, len(param))
+
+	for group, value := range param {
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("scopes of group %s must be a list", group)
+		}
+
+		scopes := make([]string, 0, len(list))
+		for _, scope := range list {
+			scopeString, ok := scope.(string)
+			if !ok {
+				return nil, fmt.Errorf("scopes of group %s must be strings", group)
+			}
+			scopes = append(scopes, scopeString)
+		}
+
+		groups[group] = scopes
+	}
+
+	return groups, nil
+}
+
+// registerMethod registers an RPC method on the connection's client, timing every call for the metrics endpoint
+func (ws *WS) registerMethod(name string, params []parameters.Param, handler func(map[string]parameters.Param) (json.RawMessage, error)) {
+	ws.client.RegisterMethod(name, params, func(params map[string]parameters.Param) (json.RawMessage, error) {
+		start := time.Now()
+
+		var result json.RawMessage
+		var err error
+		if target, ok := auditedMethods[name]; ok {
+			result, err = ws.audit(name, target, params, handler)
+		} else {
+			result, err = handler(params)
+		}
+
+		metrics.ObserveRPC(name, start, err)
+		return result, err
+	})
+}
+
+// addPeer creates a peer in the requested group from the shared peers.add parameters
+func addPeer(guard *Guard.Guard, state *state.State, scope, publicKey string, params map[string]parameters.Param) (*Guard.Peer, error) {
+	validGroups := state.GetScopeGroups(scope)
+
+	if len(validGroups) == 0 {
+		return nil, fmt.Errorf("please authenticate")
+	}
+
+	group, _ := params["group"].(*parameters.StringParam).GetString()
+	name, _ := params["name"].(*parameters.StringParam).GetString()
+	desc, _ := params["description"].(*parameters.StringParam).GetString()
+	keepAlive, _ := params["keepAlive"].(*parameters.StringParam).GetString()
+	presharedKey, _ := params["presharedKey"].(*parameters.StringParam).GetString()
+	endpoint, _ := params["endpoint"].(*parameters.StringParam).GetString()
+	allowedIPs, _ := params["allowedIPs"].(*IPNetParam).GetIPNet()
+	storage, _ := params["storage"].(*InterfaceParam).GetInterface()
+
+	expiresAt, _, err := parseExpiry(params)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ok := validGroups[group]
+	_, adminOk := validGroups["*"]
+
+	if !ok && !adminOk {
+		return nil, fmt.Errorf("please authenticate")
+	}
+
+	keepAliveDuration := time.Duration(0)
+
+	if keepAlive != "-1s" {
+		keepAliveDuration, _ = time.ParseDuration(keepAlive)
+	}
+
+	peer := Guard.CreatePeer(
+		publicKey,
+		group,
+		name,
+		desc,
+		keepAliveDuration,
+		allowedIPs,
+		guard.FormatUpdateStorage(nil, storage),
+	)
+	if endpoint != "none" {
+		peer.Endpoint = endpoint
+	}
+	peer.ExpiresAt = expiresAt
+
+	if presharedKey == "true" || (presharedKey == "" && guard.GroupWantsPresharedKey(group)) {
+		peer.PresharedKey, err = Guard.GeneratePresharedKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = guard.SetPeer(peer)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return peer, nil
+}
+
+// parseExpiry reads the expiresAt (RFC3339) and ttl (duration) parameters, set is false when neither was given.
+// Either one set to "never" clears the expiry.
+func parseExpiry(params map[string]parameters.Param) (expiresAt time.Time, set bool, err error) {
+	expiresAtString, _ := params["expiresAt"].(*parameters.StringParam).GetString()
+	ttl, _ := params["ttl"].(*parameters.StringParam).GetString()
+
+	if expiresAtString == "never" || ttl == "never" {
+		return time.Time{}, true, nil
+	}
+
+	if expiresAtString != "" {
+		expiresAt, err = time.Parse(time.RFC3339, expiresAtString)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid expiresAt")
+		}
+	} else if ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return time.Time{}, false, fmt.Errorf("invalid ttl")
+		}
+		expiresAt = time.Now().Add(duration)
+	} else {
+		return time.Time{}, false, nil
+	}
+
+	if !expiresAt.After(time.Now()) {
+		return time.Time{}, false, fmt.Errorf("expiresAt must be in the future")
+	}
+
+	return expiresAt, true, nil
+}
+
+func (ws *WS) Handler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+	defer ws.unsubscribeAll()
+
+	ws.remoteAddr = r.RemoteAddr
+	defer close(ws.closed)
+
+	writer := rpc.MakeSocketWriterChan(conn)
+	go ws.forwardNotifications(writer)
+
+	ws.client.UseChannels(rpc.MakeSocketReaderChan(conn), writer)
 }